@@ -0,0 +1,106 @@
+package opi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// POSIX ACLs are stored by Linux in these extended attributes
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// Tags of the ACL entries
+const (
+	ACLUserObj  = 0x01
+	ACLUser     = 0x02
+	ACLGroupObj = 0x04
+	ACLGroup    = 0x08
+	ACLMask     = 0x10
+	ACLOther    = 0x20
+)
+
+const (
+	aclXattrVersion = 2
+	aclUndefinedId  = ^uint32(0)
+)
+
+// Only entries tagged ACLUser or ACLGroup have an Id
+type ACLEntry struct {
+	Tag  uint16
+	Perm uint16
+	Id   uint32
+}
+
+type ACL []ACLEntry
+
+// The xattr representation is a little endian version number, followed by
+// (tag, perm, id) entries of 2, 2 and 4 bytes.
+func ParseACLXattr(data []byte) (ACL, error) {
+	if len(data) < 4 || (len(data)-4)%8 != 0 {
+		return nil, errors.New("Invalid ACL length")
+	}
+	if v := binary.LittleEndian.Uint32(data); v != aclXattrVersion {
+		return nil, fmt.Errorf("Unsupported ACL version %d", v)
+	}
+	var a ACL
+	for i := 4; i < len(data); i += 8 {
+		a = append(a, ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(data[i:]),
+			Perm: binary.LittleEndian.Uint16(data[i+2:]),
+			Id:   binary.LittleEndian.Uint32(data[i+4:]),
+		})
+	}
+	return a, nil
+}
+
+func (a ACL) XattrValue() []byte {
+	data := make([]byte, 4+8*len(a))
+	binary.LittleEndian.PutUint32(data, aclXattrVersion)
+	for i, e := range a {
+		id := e.Id
+		if e.Tag != ACLUser && e.Tag != ACLGroup {
+			id = aclUndefinedId
+		}
+		binary.LittleEndian.PutUint16(data[4+8*i:], e.Tag)
+		binary.LittleEndian.PutUint16(data[6+8*i:], e.Perm)
+		binary.LittleEndian.PutUint32(data[8+8*i:], id)
+	}
+	return data
+}
+
+// The short text form of getfacl, e.g. user::rw-,user:1000:r--,group::r--
+func (a ACL) String() string {
+	var entries []string
+	for _, e := range a {
+		var qualifier string
+		if e.Tag == ACLUser || e.Tag == ACLGroup {
+			qualifier = fmt.Sprint(e.Id)
+		}
+		perm := []byte("---")
+		for i, c := range "rwx" {
+			if e.Perm&(4>>uint(i)) != 0 {
+				perm[i] = byte(c)
+			}
+		}
+		entries = append(entries, fmt.Sprintf("%s:%s:%s", aclTagName(e.Tag), qualifier, perm))
+	}
+	return strings.Join(entries, ",")
+}
+
+func aclTagName(tag uint16) string {
+	switch tag {
+	case ACLUserObj, ACLUser:
+		return "user"
+	case ACLGroupObj, ACLGroup:
+		return "group"
+	case ACLMask:
+		return "mask"
+	case ACLOther:
+		return "other"
+	}
+	return fmt.Sprintf("tag%d", tag)
+}
@@ -1,15 +1,107 @@
 package opi
 
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrNotFound is returned by Storage.Get, Storage.Hit and Storage.GetRef
+// when the key is not stored
+var ErrNotFound = errors.New("Key not found")
+
+// ErrInvalidName is returned for the snapshot names that would not survive
+// being sent as a path: empty, or with an empty, "." or ".." segment
+var ErrInvalidName = errors.New("Invalid snapshot name")
+
+func checkName(name []byte) error {
+	for _, segment := range strings.Split(string(name), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidName
+		}
+	}
+	return nil
+}
+
+// What Archive does with a file that cannot be read
+type ErrorPolicy int
+
+const (
+	// The archive fails
+	AbortOnError ErrorPolicy = iota
+	// The file is left out of the snapshot, and reported
+	SkipOnError
+)
+
+type ArchiveOptions struct {
+	OnError ErrorPolicy
+	// Whether the skipped files are listed in the commit
+	RecordSkipped bool
+	// Patterns of the files not archived, with the syntax of .gitignore,
+	// relative to the archived directory. Patterns found in .opiignore
+	// files are relative to their directory.
+	Exclude []string
+	// Files listing such patterns, one per line
+	ExcludeFiles []string
+	// Whether the content of the directories tagged with CACHEDIR.TAG is
+	// left out. The directory and the tag are kept, like tar does.
+	ExcludeCaches bool
+	// Whether the access times are recorded. Archiving reads the files,
+	// so the directories holding them are then stored again on every run.
+	RecordAtime bool
+}
+
+// What a restore does with the files already present at the destination
+type RestoreMode int
+
+const (
+	// The restore fails
+	FailIfExists RestoreMode = iota
+	// They are replaced
+	Overwrite
+	// Only those that differ from the snapshot are replaced
+	Sync
+)
+
+type RestoreOptions struct {
+	Mode RestoreMode
+	// Whether the files missing from the snapshot are deleted from the
+	// destination. It requires Overwrite or Sync.
+	Delete bool
+}
+
 type Timeline interface {
 	Archive(path string, name string) (err error)
+	ArchiveWith(path string, name string, opts ArchiveOptions) (skipped []SkippedFile, err error)
 	Restore(name string, path string) (err error)
+	RestorePath(name string, inner string, path string) (err error)
+	RestoreWith(name string, inner string, path string, opts RestoreOptions) (err error)
+	Cat(name string, inner string, stream io.Writer) (err error)
+	Ls(name string, inner string, recursive bool, fn func(path string, e *DirEntry) error) (err error)
+	Size(e *DirEntry) (size uint64, err error)
+	GC(dryRun bool) (count int, size uint64, err error)
+	Remove(name string) (err error)
+	Prune(name string, keep int) (err error)
+	Snapshots(fn func(name string, addr []byte, c *Commit) error) (err error)
+	History(name string, fn func(addr []byte, c *Commit) error) (err error)
 }
 
 type Storage interface {
 	Get(key []byte) (value []byte, err error)
 	Set(key []byte, value []byte) (err error)
 	Del(key []byte) (err error)
+	// Hit returns nil if the key is stored, ErrNotFound otherwise
 	Hit(key []byte) (err error)
+	// Keys calls fn on every key starting with prefix, in lexical order,
+	// and stops at the first error returned by fn. fn must not modify
+	// the storage.
+	Keys(prefix []byte, fn func(key []byte) error) (err error)
+	// Snapshot names live in their own namespace, so that they can
+	// neither collide with object addresses nor be mistaken for them
+	GetRef(name []byte) (value []byte, err error)
+	SetRef(name []byte, value []byte) (err error)
+	DelRef(name []byte) (err error)
+	Refs(prefix []byte, fn func(name []byte) error) (err error)
 	Close() (err error)
 }
 
@@ -17,3 +109,9 @@ type Codec interface {
 	Encode(raw []byte) (enc []byte, err error)
 	Decode(enc []byte) (raw []byte, err error)
 }
+
+// A Codec implementing Addresser decides the addresses of the objects,
+// which are otherwise the Hash of their content
+type Addresser interface {
+	Address(raw []byte) (addr []byte)
+}
@@ -1,10 +1,13 @@
 package opi
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 )
 
 func init() {
@@ -21,36 +24,171 @@ func NewClient() Storage {
 	}
 }
 
+// Snapshot names are served under this prefix, object addresses on the root
+const refsPrefix = "refs/"
+
+// Keys may contain any byte, they must be escaped
+func (c *Client) url(prefix string, key []byte) string {
+	return c.Host + prefix + url.PathEscape(string(key))
+}
+
 func (c *Client) Get(key []byte) (value []byte, err error) {
-	resp, err := http.Get(c.Host + string(key))
+	resp, err := http.Get(c.url("", key))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	value, err = ioutil.ReadAll(resp.Body)
-	return
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	}
+	return nil, fmt.Errorf("Could not get %s: %s", key, resp.Status)
 }
 
 func (c *Client) Set(key, value []byte) (err error) {
-	resp, err := http.Post(c.Host+string(key),
-		"application/x-www-form-urlencoded",
-		bytes.NewReader(value))
+	return c.post(c.url("", key), value)
+}
+
+func (c *Client) Del(key []byte) (err error) {
+	return c.delete(c.url("", key))
+}
+
+func (c *Client) Hit(key []byte) (err error) {
+	resp, err := http.Head(c.url("", key))
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(ioutil.Discard, resp.Body)
 	defer resp.Body.Close()
-	return
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	return fmt.Errorf("Could not check %s: %s", key, resp.Status)
 }
 
-func (c *Client) Del(key []byte) (err error) {
+func (c *Client) Keys(prefix []byte, fn func(key []byte) error) (err error) {
+	return c.list("", prefix, fn)
+}
+
+func (c *Client) GetRef(name []byte) (value []byte, err error) {
+	if err = checkName(name); err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(c.url(refsPrefix, name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	}
+	return nil, fmt.Errorf("Could not get %s: %s", name, resp.Status)
+}
+
+func (c *Client) SetRef(name, value []byte) (err error) {
+	if err = checkName(name); err != nil {
+		return err
+	}
+	return c.post(c.url(refsPrefix, name), value)
+}
+
+func (c *Client) DelRef(name []byte) (err error) {
+	if err = checkName(name); err != nil {
+		return err
+	}
+	return c.delete(c.url(refsPrefix, name))
+}
+
+func (c *Client) Refs(prefix []byte, fn func(name []byte) error) (err error) {
+	return c.list(refsPrefix, prefix, fn)
+}
+
+func (c *Client) Close() (err error) {
 	return nil
 }
 
-func (c *Client) Hit(key []byte) (err error) {
+func (c *Client) post(u string, value []byte) (err error) {
+	resp, err := http.Post(u,
+		"application/x-www-form-urlencoded",
+		bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err = io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not store %s: %s", u, resp.Status)
+	}
 	return nil
 }
 
-func (c *Client) Close() (err error) {
+func (c *Client) delete(u string) (err error) {
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not delete %s: %s", u, resp.Status)
+	}
 	return nil
 }
+
+// Fetches the listing page by page, each page starting after the last key
+// of the previous one.
+func (c *Client) list(namespace string, prefix []byte, fn func(key []byte) error) (err error) {
+	after := ""
+	for {
+		keys, err := c.listPage(namespace, string(prefix), after)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, key := range keys {
+			if err = fn(key); err != nil {
+				return err
+			}
+		}
+		after = string(keys[len(keys)-1])
+	}
+}
+
+// The listing is served on the root of the namespace, one query escaped
+// key per line
+func (c *Client) listPage(namespace, prefix, after string) (keys [][]byte, err error) {
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	q.Set("after", after)
+	resp, err := http.Get(c.Host + namespace + "?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not list keys: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		key, err := url.QueryUnescape(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, []byte(key))
+	}
+	return keys, scanner.Err()
+}
@@ -1,6 +1,18 @@
 package opi
 
-import "github.com/golang/snappy"
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"golang.org/x/crypto/chacha20poly1305"
+)
 
 type SimpleCodec struct{}
 
@@ -15,3 +27,334 @@ func (c *SimpleCodec) Decode(enc []byte) ([]byte, error) {
 func NewSimpleCodec() Codec {
 	return &SimpleCodec{}
 }
+
+// ZstdCodec compresses with Zstandard, optionally with a dictionary trained
+// on similar objects. Objects compressed with a dictionary can only be
+// decoded with it.
+type ZstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (c *ZstdCodec) Encode(raw []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(raw, nil), nil
+}
+
+func (c *ZstdCodec) Decode(enc []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(enc, nil)
+}
+
+// NewZstdCodec returns a codec compressing at level, from 1 (fastest) to
+// 22 (smallest), with dict unless it is nil
+func NewZstdCodec(level int, dict []byte) (Codec, error) {
+	var dicts [][]byte
+	if dict != nil {
+		dicts = append(dicts, dict)
+	}
+	return newZstdCodec(level, dict, dicts)
+}
+
+// Returns a codec compressing with dict, and decoding the objects
+// compressed with any of dicts
+func newZstdCodec(level int, dict []byte, dicts [][]byte) (Codec, error) {
+	eopts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level))}
+	var dopts []zstd.DOption
+	if dict != nil {
+		eopts = append(eopts, zstd.WithEncoderDict(dict))
+	}
+	if len(dicts) > 0 {
+		dopts = append(dopts, zstd.WithDecoderDicts(dicts...))
+	}
+	encoder, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		return nil, err
+	}
+	return &ZstdCodec{encoder: encoder, decoder: decoder}, nil
+}
+
+// Dictionaries are stored among the objects under this prefix followed by
+// their ID, which the objects compressed with them carry
+const zstdDictPrefix = repoPrefix + "zstd-dict/"
+
+// SetZstd makes c compress with Zstandard at level, with dict unless it is
+// nil, and decode the objects compressed with any dictionary of the
+// repository s. dict is stored in s, through c so that it is encrypted as
+// well: it holds pieces of the objects it was trained on.
+func SetZstd(s Storage, c *FramedCodec, level int, dict []byte) error {
+	if dict != nil {
+		info, err := zstd.InspectDictionary(dict)
+		if err != nil {
+			return err
+		}
+		if info.ID() == 0 {
+			return errors.New("The dictionary has no ID")
+		}
+		key := []byte(fmt.Sprintf("%s%d", zstdDictPrefix, info.ID()))
+		switch stored, err := s.Get(key); {
+		case err != nil && err != ErrNotFound:
+			return err
+		case err == nil && len(stored) > 0:
+			if stored, err = c.Decode(stored); err != nil {
+				return err
+			}
+			if !bytes.Equal(stored, dict) {
+				return fmt.Errorf("Another dictionary with ID %d is stored", info.ID())
+			}
+		default:
+			enc, err := c.Encode(dict)
+			if err != nil {
+				return err
+			}
+			if err = s.Set(key, enc); err != nil {
+				return err
+			}
+		}
+	}
+	var dicts [][]byte
+	err := s.Keys([]byte(zstdDictPrefix), func(key []byte) error {
+		enc, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		d, err := c.Decode(enc)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		dicts = append(dicts, d)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	codec, err := newZstdCodec(level, dict, dicts)
+	if err != nil {
+		return err
+	}
+	c.Compressors[CompressionZstd] = codec
+	return nil
+}
+
+// LZ4Codec compresses with LZ4, faster but larger than Zstandard. The LZ4
+// block is prefixed with the size of the object, or with 0 if it was stored
+// as is for lack of compression.
+type LZ4Codec struct{}
+
+func (c *LZ4Codec) Encode(raw []byte) ([]byte, error) {
+	enc := make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(raw)))
+	n := binary.PutUvarint(enc, uint64(len(raw)))
+	m, err := lz4.CompressBlock(raw, enc[n:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if m == 0 || m >= len(raw) {
+		return append([]byte{0}, raw...), nil
+	}
+	return enc[:n+m], nil
+}
+
+func (c *LZ4Codec) Decode(enc []byte) ([]byte, error) {
+	size, n := binary.Uvarint(enc)
+	if n <= 0 {
+		return nil, errors.New("Invalid LZ4 object")
+	}
+	if size == 0 {
+		return enc[n:], nil
+	}
+	// LZ4 cannot compress more than 255 times
+	if size > 255*uint64(len(enc)) {
+		return nil, errors.New("Invalid LZ4 object size")
+	}
+	raw := make([]byte, size)
+	m, err := lz4.UncompressBlock(enc[n:], raw)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(m) != size {
+		return nil, errors.New("Truncated LZ4 object")
+	}
+	return raw, nil
+}
+
+func NewLZ4Codec() Codec {
+	return &LZ4Codec{}
+}
+
+// Encoded objects start with a header: the magic "OPI", the version of the
+// framing, then the ids of the compression and of the encryption applied to
+// the rest of the object.
+const (
+	frameMagic   = "OPI"
+	frameVersion = 1
+	headerSize   = len(frameMagic) + 3
+)
+
+// Compressions
+const (
+	CompressionNone   = 0
+	CompressionSnappy = 1
+	CompressionZstd   = 2
+	CompressionLZ4    = 3
+)
+
+// Level of Zstandard used by default
+const DefaultZstdLevel = 3
+
+// Encryptions. Encrypted objects are the random nonce followed by the
+// sealed compressed object, authenticated along with the header.
+const (
+	EncryptionNone              = 0
+	EncryptionXChaCha20Poly1305 = 1
+)
+
+// Stores objects as they are
+type rawCodec struct{}
+
+func (c rawCodec) Encode(raw []byte) ([]byte, error) {
+	return raw, nil
+}
+
+func (c rawCodec) Decode(enc []byte) ([]byte, error) {
+	return enc, nil
+}
+
+// FramedCodec encodes objects with Compression, and encrypts them if it
+// has a key. It decodes the objects written with any compression of
+// Compressors, and those written before framing with the Legacy codecs.
+// Objects that compression does not shrink by at least MinSaving, a
+// fraction of their size, are stored uncompressed: decoding them is free.
+//
+// With a key, objects stored in clear, framed or Legacy, are rejected:
+// whoever holds the storage could forge them. Migrating accepts them, for
+// repositories holding objects written before they were encrypted.
+type FramedCodec struct {
+	Compression byte
+	Compressors map[byte]Codec
+	Legacy      []Codec
+	MinSaving   float64
+	Migrating   bool
+	aead        cipher.AEAD
+	// Decodes the objects encrypted before framing
+	legacyEncrypted Codec
+}
+
+func (c *FramedCodec) Encode(raw []byte) ([]byte, error) {
+	compressor, ok := c.Compressors[c.Compression]
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression %d", c.Compression)
+	}
+	compressed, err := compressor.Encode(raw)
+	if err != nil {
+		return nil, err
+	}
+	compression := c.Compression
+	if c.MinSaving > 0 && float64(len(compressed)) > float64(len(raw))*(1-c.MinSaving) {
+		compressed, compression = raw, CompressionNone
+	}
+	header := append([]byte(frameMagic), frameVersion, compression, EncryptionNone)
+	if c.aead == nil {
+		return append(header, compressed...), nil
+	}
+	header[headerSize-1] = EncryptionXChaCha20Poly1305
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(append(header, nonce...), nonce, compressed, header), nil
+}
+
+func (c *FramedCodec) Decode(enc []byte) ([]byte, error) {
+	var legacy []Codec
+	if c.legacyEncrypted != nil {
+		legacy = append(legacy, c.legacyEncrypted)
+	}
+	if c.aead == nil || c.Migrating {
+		legacy = append(legacy, c.Legacy...)
+	}
+	err := errors.New("Missing object header")
+	if len(enc) >= len(frameMagic) && string(enc[:len(frameMagic)]) == frameMagic {
+		var raw []byte
+		if raw, err = c.decodeFramed(enc); err == nil {
+			return raw, nil
+		}
+		// Objects stored before framing can start with the magic too:
+		// one in 2^24 encrypted objects by their nonce, and clear ones
+		// by their content
+	}
+	for _, l := range legacy {
+		if raw, errLegacy := l.Decode(enc); errLegacy == nil {
+			return raw, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *FramedCodec) decodeFramed(enc []byte) ([]byte, error) {
+	if len(enc) < headerSize {
+		return nil, errors.New("Truncated object header")
+	}
+	header, body := enc[:headerSize], enc[headerSize:]
+	if v := header[len(frameMagic)]; v != frameVersion {
+		return nil, fmt.Errorf("Unsupported object version %d", v)
+	}
+	compressor, ok := c.Compressors[header[headerSize-2]]
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression %d", header[headerSize-2])
+	}
+	switch header[headerSize-1] {
+	case EncryptionNone:
+		if c.aead != nil && !c.Migrating {
+			return nil, errors.New("Object stored in clear in an encrypted repository")
+		}
+	case EncryptionXChaCha20Poly1305:
+		if c.aead == nil {
+			return nil, errors.New("Encrypted object, no key")
+		}
+		if len(body) < c.aead.NonceSize() {
+			return nil, errors.New("Encrypted object too short")
+		}
+		nonce, sealed := body[:c.aead.NonceSize()], body[c.aead.NonceSize():]
+		var err error
+		if body, err = c.aead.Open(nil, nonce, sealed, header); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown encryption %d", header[headerSize-1])
+	}
+	return compressor.Decode(body)
+}
+
+// NewFramedCodec returns a codec compressing with compression, without
+// encryption. Objects written before framing are decoded with SimpleCodec.
+func NewFramedCodec(compression byte) (*FramedCodec, error) {
+	zstdCodec, err := NewZstdCodec(DefaultZstdLevel, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &FramedCodec{
+		Compression: compression,
+		Compressors: map[byte]Codec{
+			CompressionNone:   rawCodec{},
+			CompressionSnappy: NewSimpleCodec(),
+			CompressionZstd:   zstdCodec,
+			CompressionLZ4:    NewLZ4Codec(),
+		},
+		Legacy: []Codec{NewSimpleCodec()},
+	}
+	return c, nil
+}
+
+// SetKey makes c encrypt with key. Objects encrypted before framing are
+// decoded with EncryptedCodec.
+func (c *FramedCodec) SetKey(key []byte) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	c.aead = aead
+	c.legacyEncrypted = &EncryptedCodec{Inner: NewSimpleCodec(), aead: aead}
+	return nil
+}
@@ -0,0 +1,135 @@
+package opi
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressors(t *testing.T) {
+	zstdCodec, err := NewZstdCodec(19, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 100)
+	for name, c := range map[string]Codec{"zstd": zstdCodec, "lz4": NewLZ4Codec()} {
+		for _, raw := range [][]byte{nil, []byte("short"), text, RandomBytes()} {
+			enc, err := c.Encode(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec, err := c.Decode(enc)
+			if err != nil || !bytes.Equal(raw, dec) {
+				t.Fatalf("%s: incorrect back and forth convertion", name)
+			}
+		}
+		if enc, _ := c.Encode(text); len(enc) >= len(text)/10 {
+			t.Fatalf("%s: text compressed to %d bytes", name, len(enc))
+		}
+	}
+}
+
+func TestZstdDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 100; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id": %d, "name": "user%d", "active": true}`, i, i)))
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{ID: 1, Contents: samples, History: bytes.Join(samples, nil), Offsets: [3]int{1, 4, 8}, Level: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewZstdCodec(DefaultZstdLevel, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte(`{"id": 1000, "name": "user1000", "active": true}`)
+	enc, err := c.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := c.Decode(enc)
+	if err != nil || !bytes.Equal(raw, dec) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+	plain, _ := NewZstdCodec(DefaultZstdLevel, nil)
+	if _, err := plain.Decode(enc); err == nil {
+		t.Fatal("Decoded without the dictionary")
+	}
+
+	// Stored in the repository, objects decode without it
+	s := newMemStorage()
+	fc := framed(t, CompressionZstd)
+	if err := SetZstd(s, fc, DefaultZstdLevel, dict); err != nil {
+		t.Fatal(err)
+	}
+	if enc, err = fc.Encode(raw); err != nil {
+		t.Fatal(err)
+	}
+	fc = framed(t, CompressionZstd)
+	if err := SetZstd(s, fc, DefaultZstdLevel, nil); err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := fc.Decode(enc); err != nil || !bytes.Equal(raw, dec) {
+		t.Fatalf("Not decoded with the stored dictionary: %v", err)
+	}
+	if err := SetZstd(s, fc, DefaultZstdLevel, dict); err != nil {
+		t.Fatalf("Dictionary stored again: %v", err)
+	}
+	other, err := zstd.BuildDict(zstd.BuildDictOptions{ID: 1, Contents: samples[50:], History: bytes.Join(samples[50:], nil), Offsets: [3]int{1, 4, 8}, Level: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetZstd(s, fc, DefaultZstdLevel, other); err == nil {
+		t.Fatal("Another dictionary with the same ID accepted")
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	c := framed(t, CompressionZstd)
+	c.MinSaving = 0.1
+	raw := RandomBytes()
+	enc, err := c.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc[headerSize-2] != CompressionNone {
+		t.Fatal("Incompressible object compressed")
+	}
+	dec, err := c.Decode(enc)
+	if err != nil || !bytes.Equal(raw, dec) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+	text := bytes.Repeat([]byte("hello "), 100)
+	if enc, _ := c.Encode(text); enc[headerSize-2] != CompressionZstd {
+		t.Fatal("Compressible object stored raw")
+	}
+}
+
+func TestLegacyObjectWithMagic(t *testing.T) {
+	// Compressed by snappy to a length of 79 ('O') and a literal of 21
+	// bytes ('P') starting with 'I'
+	head := []byte("Iabcdefghijklmnopqrst")
+	raw := append(append([]byte{}, head...), bytes.Repeat(head, 3)[:58]...)
+	enc, _ := NewSimpleCodec().Encode(raw)
+	if string(enc[:len(frameMagic)]) != frameMagic {
+		t.Fatalf("Expected the magic, got %q", enc[:len(frameMagic)])
+	}
+	c := framed(t, CompressionSnappy)
+	dec, err := c.Decode(enc)
+	if err != nil || !bytes.Equal(raw, dec) {
+		t.Fatalf("Legacy object not decoded: %v", err)
+	}
+	// Not in an encrypted repository, unless migrating
+	if err := c.SetKey(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Decode(enc); err == nil {
+		t.Fatal("Object in clear accepted")
+	}
+	c.Migrating = true
+	if dec, err := c.Decode(enc); err != nil || !bytes.Equal(raw, dec) {
+		t.Fatalf("Legacy object not decoded while migrating: %v", err)
+	}
+}
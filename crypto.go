@@ -0,0 +1,324 @@
+package opi
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	bencode "github.com/jackpal/bencode-go"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrWrongPassphrase is returned when the key file cannot be unwrapped
+var ErrWrongPassphrase = errors.New("Wrong passphrase")
+
+// ErrConfigAltered is returned when the configuration of an encrypted
+// repository is not the one its key file was sealed with
+var ErrConfigAltered = errors.New("The configuration of the repository was altered")
+
+// Key of the key file among the objects
+var keyFileKey = []byte(repoPrefix + "key")
+
+// Cost of the key derivation, as recommended by RFC 9106 for memory
+// constrained environments
+const (
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024 // KiB
+	kdfThreads = 4
+)
+
+// The key file comes from the storage, which must not be able to exhaust
+// the resources of the host with its costs
+const (
+	kdfMaxTime    = 16
+	kdfMaxMemory  = 1024 * 1024 // KiB
+	kdfMaxThreads = 64
+)
+
+// EncryptedCodec compresses objects with Inner, then seals them with
+// XChaCha20-Poly1305 under the master key of the repository. Each object is
+// prefixed with its random nonce. This is how objects were encrypted before
+// FramedCodec.
+type EncryptedCodec struct {
+	Inner Codec
+	aead  cipher.AEAD
+}
+
+func (c *EncryptedCodec) Encode(raw []byte) ([]byte, error) {
+	compressed, err := c.Inner.Encode(raw)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(compressed)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, compressed, nil), nil
+}
+
+func (c *EncryptedCodec) Decode(enc []byte) ([]byte, error) {
+	if len(enc) < c.aead.NonceSize() {
+		return nil, errors.New("Encrypted object too short")
+	}
+	nonce, sealed := enc[:c.aead.NonceSize()], enc[c.aead.NonceSize():]
+	compressed, err := c.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Inner.Decode(compressed)
+}
+
+// NewEncryptedCodec returns a codec compressing with inner and encrypting
+// with key, a 32 bytes master key
+func NewEncryptedCodec(inner Codec, key []byte) (Codec, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedCodec{Inner: inner, aead: aead}, nil
+}
+
+// KeyedCodec is Codec, with addresses that are the Hash of the content
+// keyed with a secret key. Unlike plain hashes, they do not tell whoever
+// holds the storage whether a known file was archived.
+type KeyedCodec struct {
+	Codec
+	Hash *Hash
+	key  []byte
+}
+
+func (c *KeyedCodec) Address(raw []byte) []byte {
+	return c.Hash.KeyedSum(c.key, raw)
+}
+
+func NewKeyedCodec(c Codec, h *Hash, key []byte) Codec {
+	return &KeyedCodec{Codec: c, Hash: h, key: key}
+}
+
+// KeyFile holds the master key of a repository, sealed with a key derived
+// from a passphrase with argon2id. Changing the passphrase only rewrites
+// the key file, not the objects. The master key of a repository with keyed
+// addresses is followed by the key of the addresses. The configuration of
+// the repository, stored in clear, is authenticated as the additional data
+// of the seal.
+type KeyFile struct {
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Nonce   []byte
+	Sealed  []byte
+}
+
+func (k *KeyFile) Bytes() ([]byte, error) {
+	obj := [6]interface{}{k.Salt, int64(k.Time), int64(k.Memory), int64(k.Threads), k.Nonce, k.Sealed}
+	return bencoded(obj)
+}
+
+func ReadKeyFile(data []byte) (*KeyFile, error) {
+	var obj [6]interface{}
+	r := bytes.NewReader(data)
+	if err := bencode.Unmarshal(r, &obj); err != nil {
+		return nil, err
+	}
+	salt, ok := obj[0].(string)
+	if !ok {
+		return nil, DecodeError("Salt", "KeyFile")
+	}
+	time, ok := obj[1].(int64)
+	if !ok {
+		return nil, DecodeError("Time", "KeyFile")
+	}
+	memory, ok := obj[2].(int64)
+	if !ok {
+		return nil, DecodeError("Memory", "KeyFile")
+	}
+	threads, ok := obj[3].(int64)
+	if !ok {
+		return nil, DecodeError("Threads", "KeyFile")
+	}
+	nonce, ok := obj[4].(string)
+	if !ok {
+		return nil, DecodeError("Nonce", "KeyFile")
+	}
+	sealed, ok := obj[5].(string)
+	if !ok {
+		return nil, DecodeError("Sealed", "KeyFile")
+	}
+	return &KeyFile{
+		Salt:    []byte(salt),
+		Time:    uint32(time),
+		Memory:  uint32(memory),
+		Threads: uint8(threads),
+		Nonce:   []byte(nonce),
+		Sealed:  []byte(sealed),
+	}, nil
+}
+
+func (k *KeyFile) wrapping(passphrase []byte) (cipher.AEAD, error) {
+	if k.Time < 1 || k.Time > kdfMaxTime || k.Memory > kdfMaxMemory || k.Threads < 1 || k.Threads > kdfMaxThreads {
+		return nil, errors.New("Invalid key derivation parameters")
+	}
+	kek := argon2.IDKey(passphrase, k.Salt, k.Time, k.Memory, k.Threads, chacha20poly1305.KeySize)
+	return chacha20poly1305.NewX(kek)
+}
+
+// NewKeyFile generates a master key, and the key of the addresses if keyed,
+// and wraps them with passphrase, authenticating config
+func NewKeyFile(passphrase []byte, keyed bool, config []byte) (k *KeyFile, key []byte, addressKey []byte, err error) {
+	k = &KeyFile{
+		Salt:    make([]byte, 16),
+		Time:    kdfTime,
+		Memory:  kdfMemory,
+		Threads: kdfThreads,
+		Nonce:   make([]byte, chacha20poly1305.NonceSizeX),
+	}
+	keys := make([]byte, chacha20poly1305.KeySize)
+	if keyed {
+		keys = make([]byte, 2*chacha20poly1305.KeySize)
+	}
+	for _, b := range [][]byte{k.Salt, k.Nonce, keys} {
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	aead, err := k.wrapping(passphrase)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	k.Sealed = aead.Seal(nil, k.Nonce, keys, config)
+	key, addressKey = splitKeys(keys)
+	return k, key, addressKey, nil
+}
+
+// Unwrap returns the master key and the key of the addresses, nil if they
+// are not keyed, or ErrWrongPassphrase. It returns ErrConfigAltered if
+// config is not the one the key file was sealed with.
+func (k *KeyFile) Unwrap(passphrase []byte, config []byte) (key []byte, addressKey []byte, err error) {
+	aead, err := k.wrapping(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(k.Nonce) != aead.NonceSize() {
+		return nil, nil, errors.New("Invalid key file")
+	}
+	keys, err := aead.Open(nil, k.Nonce, k.Sealed, config)
+	if err != nil {
+		// Sealed before the configuration was recorded, or with another
+		// one
+		if config != nil {
+			if _, err = aead.Open(nil, k.Nonce, k.Sealed, nil); err == nil {
+				return nil, nil, ErrConfigAltered
+			}
+		}
+		return nil, nil, ErrWrongPassphrase
+	}
+	if len(keys) != chacha20poly1305.KeySize && len(keys) != 2*chacha20poly1305.KeySize {
+		return nil, nil, errors.New("Invalid key file")
+	}
+	key, addressKey = splitKeys(keys)
+	return key, addressKey, nil
+}
+
+func splitKeys(keys []byte) (key []byte, addressKey []byte) {
+	key = keys[:chacha20poly1305.KeySize]
+	if len(keys) > chacha20poly1305.KeySize {
+		addressKey = keys[chacha20poly1305.KeySize:]
+	}
+	return key, addressKey
+}
+
+// Returns c encrypting with key, and addressing with addressKey if not nil,
+// with the hash of cfg
+func encryptedCodec(c *FramedCodec, cfg *Config, key []byte, addressKey []byte) (Codec, error) {
+	if err := c.SetKey(key); err != nil {
+		return nil, err
+	}
+	if addressKey == nil {
+		return c, nil
+	}
+	return NewKeyedCodec(c, cfg.Hash, addressKey), nil
+}
+
+// Returns the configuration authenticated by the key file, nil for the
+// repositories without a recorded one
+func sealedConfig(cfg *Config) ([]byte, error) {
+	if cfg.Hash == HashLegacy {
+		return nil, nil
+	}
+	return cfg.Bytes()
+}
+
+// IsEncrypted tells whether the repository s has a key file
+func IsEncrypted(s Storage) (bool, error) {
+	switch err := s.Hit(keyFileKey); err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// InitEncryption stores a new key file in the repository s, and returns c
+// encrypting with its master key. With keyed, the addresses of the objects
+// are keyed as well. It fails if s already has a key file. cfg is the
+// configuration of s, as returned by OpenConfig, which the key file
+// authenticates.
+func InitEncryption(s Storage, c *FramedCodec, cfg *Config, passphrase []byte, keyed bool) (Codec, error) {
+	encrypted, err := IsEncrypted(s)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		return nil, errors.New("The repository already has a key file")
+	}
+	config, err := sealedConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	k, key, addressKey, err := NewKeyFile(passphrase, keyed, config)
+	if err != nil {
+		return nil, err
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	// The key file is stored as is: it cannot go through the codec it
+	// configures
+	if err = s.Set(keyFileKey, b); err != nil {
+		return nil, err
+	}
+	return encryptedCodec(c, cfg, key, addressKey)
+}
+
+// OpenEncryption returns c encrypting with the master key of the
+// repository s, unwrapped with passphrase. It fails with ErrConfigAltered
+// if cfg, as returned by OpenConfig, is not the configuration the key file
+// was sealed with.
+func OpenEncryption(s Storage, c *FramedCodec, cfg *Config, passphrase []byte) (Codec, error) {
+	b, err := s.Get(keyFileKey)
+	if err == nil && len(b) == 0 {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	k, err := ReadKeyFile(b)
+	if err != nil {
+		return nil, err
+	}
+	config, err := sealedConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	key, addressKey, err := k.Unwrap(passphrase, config)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedCodec(c, cfg, key, addressKey)
+}
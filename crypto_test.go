@@ -0,0 +1,290 @@
+package opi
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedCodec(t *testing.T) {
+	c, err := NewEncryptedCodec(NewSimpleCodec(), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := RandomBytes()
+	enc, err := c.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := c.Encode(raw)
+	if bytes.Equal(enc, again) {
+		t.Fatal("Nonces are reused")
+	}
+	dec, err := c.Decode(enc)
+	if err != nil || !bytes.Equal(raw, dec) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+	enc[len(enc)-1] ^= 1
+	if _, err := c.Decode(enc); err == nil {
+		t.Fatal("Expected an error for a tampered object")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	config, _ := (&Config{Hash: HashBLAKE3}).Bytes()
+	k, key, addressKey, err := NewKeyFile([]byte("secret"), true, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRes, err := ReadKeyFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, unwrappedAddressKey, err := readRes.Unwrap([]byte("secret"), config)
+	if err != nil || !bytes.Equal(key, unwrapped) || !bytes.Equal(addressKey, unwrappedAddressKey) {
+		t.Fatal("Incorrect key unwrapped")
+	}
+	if _, _, err := readRes.Unwrap([]byte("guess"), config); err != ErrWrongPassphrase {
+		t.Fatalf("Expected %v, got %v", ErrWrongPassphrase, err)
+	}
+	other, _ := (&Config{Hash: HashSHA256}).Bytes()
+	if _, _, err := readRes.Unwrap([]byte("secret"), other); err == nil {
+		t.Fatal("Another configuration accepted")
+	}
+	// A configuration recorded after the key file
+	k, _, _, err = NewKeyFile([]byte("secret"), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := k.Unwrap([]byte("secret"), config); err != ErrConfigAltered {
+		t.Fatalf("Expected %v, got %v", ErrConfigAltered, err)
+	}
+	// The costs and the nonce come from the storage
+	for _, bad := range []KeyFile{
+		{Salt: k.Salt, Time: k.Time, Memory: 1 << 31, Threads: k.Threads, Nonce: k.Nonce, Sealed: k.Sealed},
+		{Salt: k.Salt, Time: 0, Memory: k.Memory, Threads: k.Threads, Nonce: k.Nonce, Sealed: k.Sealed},
+		{Salt: k.Salt, Time: k.Time, Memory: k.Memory, Threads: k.Threads, Nonce: k.Nonce[:8], Sealed: k.Sealed},
+	} {
+		if _, _, err := bad.Unwrap([]byte("secret"), nil); err == nil || err == ErrWrongPassphrase {
+			t.Fatalf("Expected an invalid key file, got %v", err)
+		}
+	}
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	s := newMemStorage()
+	c, err := InitEncryption(s, framed(t, CompressionSnappy), legacyConfig, []byte("secret"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitEncryption(s, framed(t, CompressionSnappy), legacyConfig, []byte("secret"), false); err == nil {
+		t.Fatal("Expected an error for an existing key file")
+	}
+	if err := NewOpi(s, c).Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is stored in clear
+	for _, value := range s.objects {
+		if bytes.Contains(value, []byte("hello")) {
+			t.Fatal("Content stored in clear")
+		}
+	}
+	if _, err := OpenEncryption(s, framed(t, CompressionSnappy), legacyConfig, []byte("guess")); err != ErrWrongPassphrase {
+		t.Fatalf("Expected %v, got %v", ErrWrongPassphrase, err)
+	}
+	c, err = OpenEncryption(s, framed(t, CompressionSnappy), legacyConfig, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpi(s, c)
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := ioutil.ReadFile(filepath.Join(dst, "small")); string(actual) != "hello" {
+		t.Fatal("Incorrect file restored")
+	}
+	// The key file is not garbage
+	if count, _, err := o.GC(true); err != nil || count != 0 {
+		t.Fatalf("Unexpected garbage: %d, %v", count, err)
+	}
+	// An authentic object served in place of another is detected
+	tree, err := o.(*Opi).TreeOf("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := o.(*Opi).Lookup(tree, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.objects[string(small.Addr)] = s.objects[string(tree)]
+	if err := o.Cat("test", "small", ioutil.Discard); err != ErrCorrupt {
+		t.Fatalf("Expected %v, got %v", ErrCorrupt, err)
+	}
+}
+
+func TestKeyedAddresses(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	s := newMemStorage()
+	c, err := InitEncryption(s, framed(t, CompressionSnappy), legacyConfig, []byte("secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpi(s, c).(*Opi)
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// The address of a known content is not its hash
+	chunk, _ := NewChunk([]byte("hello")).Bytes()
+	if _, ok := s.objects[fmt.Sprintf("%x", sha512.Sum512(chunk))]; ok {
+		t.Fatal("Unkeyed address found")
+	}
+	e, err := o.Lookup(mustTree(t, o, "test"), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.hash.isAddr(e.Addr) {
+		t.Fatalf("Invalid address %s", e.Addr)
+	}
+	// Reopened, the repository deduplicates with the same key
+	c, err = OpenEncryption(s, framed(t, CompressionSnappy), legacyConfig, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := mustTree(t, o, "test")
+	sets := s.sets
+	reopened := NewOpi(s, c).(*Opi)
+	if err := reopened.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the new commit is written
+	if s.sets-sets != 1 {
+		t.Fatalf("Expected 1 write, got %d", s.sets-sets)
+	}
+	if !bytes.Equal(mustTree(t, reopened, "test"), tree) {
+		t.Fatal("The tree has another address")
+	}
+}
+
+func mustTree(t *testing.T, o *Opi, name string) []byte {
+	tree, err := o.TreeOf(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestFramedCodec(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	raw := RandomBytes()
+	for _, k := range [][]byte{nil, key} {
+		for _, compression := range []byte{CompressionNone, CompressionSnappy} {
+			c := framed(t, compression)
+			if k != nil {
+				if err := c.SetKey(k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			enc, err := c.Encode(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec, err := c.Decode(enc)
+			if err != nil || !bytes.Equal(raw, dec) {
+				t.Fatal("Incorrect back and forth convertion\n")
+			}
+		}
+	}
+	// The header is authenticated
+	c := framed(t, CompressionSnappy)
+	c.SetKey(key)
+	enc, _ := c.Encode(raw)
+	enc[headerSize-2] = CompressionNone
+	if _, err := c.Decode(enc); err == nil {
+		t.Fatal("Expected an error for a tampered header")
+	}
+	// A tampered object is not taken for a legacy one
+	enc, _ = c.Encode(raw)
+	enc[len(enc)-1] ^= 1
+	if _, err := c.Decode(enc); err == nil {
+		t.Fatal("Expected an error for a tampered object")
+	}
+	// Objects written before framing
+	legacy, _ := NewEncryptedCodec(NewSimpleCodec(), key)
+	enc, _ = legacy.Encode(raw)
+	if dec, err := c.Decode(enc); err != nil || !bytes.Equal(raw, dec) {
+		t.Fatal("Legacy object not decoded")
+	}
+	// Objects in clear are only decoded while migrating
+	clear, _ := framed(t, CompressionSnappy).Encode(raw)
+	legacyClear, _ := NewSimpleCodec().Encode(raw)
+	for _, enc := range [][]byte{clear, legacyClear} {
+		if _, err := c.Decode(enc); err == nil {
+			t.Fatal("Object in clear decoded")
+		}
+		c.Migrating = true
+		if dec, err := c.Decode(enc); err != nil || !bytes.Equal(raw, dec) {
+			t.Fatal("Object in clear not decoded while migrating")
+		}
+		c.Migrating = false
+	}
+}
+
+func TestMigrateCodec(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	s := newMemStorage()
+	if err := NewOpi(s, NewSimpleCodec()).Archive(src, "old"); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpi(s, framed(t, CompressionNone))
+	if err := ioutil.WriteFile(filepath.Join(src, "small"), []byte("hello again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Archive(src, "new"); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"old": "hello", "new": "hello again"} {
+		var b bytes.Buffer
+		if err := o.Cat(name, "small", &b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Fatalf("%s: unexpected content %q", name, b.String())
+		}
+	}
+}
+
+// Configuration of the repositories opened with NewOpi
+var legacyConfig = &Config{Hash: HashLegacy}
+
+func framed(t *testing.T, compression byte) *FramedCodec {
+	c, err := NewFramedCodec(compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -2,7 +2,6 @@ package opi
 
 import (
 	"bytes"
-	"fmt"
 	"log"
 	"os/user"
 	"time"
@@ -11,8 +10,9 @@ import (
 )
 
 type DB struct {
-	db         *bolt.DB
-	bucketName []byte
+	db             *bolt.DB
+	bucketName     []byte
+	refsBucketName []byte
 }
 
 func NewDB() Storage {
@@ -21,12 +21,23 @@ func NewDB() Storage {
 	if err != nil {
 		log.Fatal(err)
 	}
-	dbPath := u.HomeDir + "/.opi.db"
-	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	d, err := openDB(u.HomeDir + "/.opi.db")
 	if err != nil {
 		log.Fatal(err)
 	}
-	return &DB{db: db, bucketName: []byte("objects")}
+	return d
+}
+
+func openDB(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &DB{
+		db:             db,
+		bucketName:     []byte("objects"),
+		refsBucketName: []byte("refs"),
+	}, nil
 }
 
 func (d *DB) Close() error {
@@ -34,8 +45,74 @@ func (d *DB) Close() error {
 }
 
 func (d *DB) Set(key, value []byte) error {
-	d.db.Batch(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(d.bucketName)
+	return d.put(d.bucketName, key, value)
+}
+
+func (d *DB) Get(key []byte) (value []byte, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(d.bucketName)
+		if bucket == nil {
+			return ErrNotFound
+		}
+		v := bucket.Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return
+}
+
+func (d *DB) Del(key []byte) (err error) {
+	return d.delete(d.bucketName, key)
+}
+
+func (d *DB) Keys(prefix []byte, fn func(key []byte) error) error {
+	return d.keys(d.bucketName, prefix, fn)
+}
+
+func (d *DB) Hit(key []byte) (err error) {
+	return d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(d.bucketName)
+		if bucket == nil || bucket.Get(key) == nil {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (d *DB) GetRef(name []byte) (value []byte, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(d.refsBucketName)
+		if bucket == nil {
+			return ErrNotFound
+		}
+		v := bucket.Get(name)
+		if v == nil {
+			return ErrNotFound
+		}
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return
+}
+
+func (d *DB) SetRef(name, value []byte) error {
+	return d.put(d.refsBucketName, name, value)
+}
+
+func (d *DB) DelRef(name []byte) error {
+	return d.delete(d.refsBucketName, name)
+}
+
+func (d *DB) Refs(prefix []byte, fn func(name []byte) error) error {
+	return d.keys(d.refsBucketName, prefix, fn)
+}
+
+func (d *DB) put(bucketName, key, value []byte) error {
+	return d.db.Batch(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketName)
 		if err != nil {
 			return err
 		}
@@ -45,22 +122,31 @@ func (d *DB) Set(key, value []byte) error {
 		}
 		return nil
 	})
-	return nil
 }
 
-func (d *DB) Get(key []byte) (value []byte, err error) {
-	err = d.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(d.bucketName)
+func (d *DB) delete(bucketName, key []byte) error {
+	return d.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
 		if bucket == nil {
-			return fmt.Errorf("Bucket %q not found!", d.bucketName)
+			return nil
 		}
-		var buffer bytes.Buffer
-		buffer.Write(bucket.Get(key))
-		value = buffer.Bytes()
-		return nil
+		return bucket.Delete(key)
 	})
-	return
 }
 
-func (d *DB) Del(key []byte) (err error) { return nil }
-func (d *DB) Hit(key []byte) (err error) { return nil }
+func (d *DB) keys(bucketName, prefix []byte, fn func(key []byte) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			// k is only valid during the transaction
+			if err := fn(append([]byte(nil), k...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,147 @@
+package opi
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Objects describing the repository itself, e.g. its key file, have keys
+// starting with this prefix
+const repoPrefix = "repo/"
+
+func isRepoKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(repoPrefix))
+}
+
+// Mark adds to reachable the address of the commit, and of every object
+// that can be reached from it.
+func (o *Opi) Mark(commit []byte, reachable map[string]bool) error {
+	if reachable[string(commit)] {
+		return nil
+	}
+	c, err := o.ReadCommitAt(commit)
+	if err != nil {
+		return err
+	}
+	reachable[string(commit)] = true
+	if err = o.markObject(c.Tree, byte('d'), reachable); err != nil {
+		return err
+	}
+	for _, p := range c.Parents {
+		if err = o.Mark(p, reachable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Opi) markObject(addr []byte, objtype byte, reachable map[string]bool) error {
+	if reachable[string(addr)] {
+		return nil
+	}
+	switch objtype {
+	case byte('d'):
+		b, err := o.DeSerialize(addr)
+		if err != nil {
+			return err
+		}
+		d, err := ReadDir(b)
+		if err != nil {
+			return err
+		}
+		for _, e := range d.Entries {
+			if err = o.markObject(e.Addr, e.FileType, reachable); err != nil {
+				return err
+			}
+			// Older directory objects hold a placeholder
+			if o.hash.isAddr(e.Xattr) {
+				reachable[string(e.Xattr)] = true
+			}
+		}
+	case byte('h'):
+		b, err := o.DeSerialize(addr)
+		if err != nil {
+			return err
+		}
+		h, err := ReadHardlink(b)
+		if err != nil {
+			return err
+		}
+		if err = o.markObject(h.Addr, h.MetaType, reachable); err != nil {
+			return err
+		}
+	case byte('S'):
+		b, err := o.DeSerialize(addr)
+		if err != nil {
+			return err
+		}
+		s, err := ReadSuperChunk(b)
+		if err != nil {
+			return err
+		}
+		for _, c := range s.Children {
+			if err = o.markObject(c.Addr, c.MetaType, reachable); err != nil {
+				return err
+			}
+		}
+	}
+	reachable[string(addr)] = true
+	return nil
+}
+
+// GC deletes the objects that cannot be reached from any snapshot name, and
+// returns their number and the space they occupied in the storage. With
+// dryRun, nothing is deleted. It must not run concurrently with Archive,
+// as the objects of an unfinished snapshot are not reachable yet.
+func (o *Opi) GC(dryRun bool) (count int, size uint64, err error) {
+	var names, addrs [][]byte
+	err = o.Keys(nil, func(key []byte) error {
+		switch addr := o.hash.keyAddr(key); {
+		case addr != nil:
+			addrs = append(addrs, addr)
+		case !isRepoKey(key):
+			names = append(names, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	err = o.Refs(nil, func(name []byte) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	// mark
+	reachable := make(map[string]bool)
+	for _, name := range names {
+		commit, err := o.Resolve(string(name))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %v", name, err)
+		}
+		if err = o.Mark(commit, reachable); err != nil {
+			return 0, 0, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	// sweep
+	for _, addr := range addrs {
+		if reachable[string(addr)] {
+			continue
+		}
+		key := o.hash.key(addr)
+		value, err := o.Get(key)
+		if err != nil {
+			return count, size, err
+		}
+		if !dryRun {
+			if err = o.Del(key); err != nil {
+				return count, size, err
+			}
+		}
+		count += 1
+		size += uint64(len(value))
+	}
+	return
+}
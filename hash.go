@@ -0,0 +1,217 @@
+package opi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+
+	bencode "github.com/jackpal/bencode-go"
+	"lukechampine.com/blake3"
+)
+
+// Key of the configuration among the objects
+var configKey = []byte(repoPrefix + "config")
+
+// Hash computes the addresses of the objects of a repository. Keyed, as
+// with KeyedCodec, the addresses are a MAC of the content.
+type Hash struct {
+	// Name recorded in the configuration
+	Name string
+	// Length of the addresses
+	Size int
+	new  func(key []byte) hash.Hash
+	// Whether the addresses are hex encoded
+	hex bool
+}
+
+func sha2(newHash func() hash.Hash) func(key []byte) hash.Hash {
+	return func(key []byte) hash.Hash {
+		if key == nil {
+			return newHash()
+		}
+		return hmac.New(newHash, key)
+	}
+}
+
+var (
+	// The hex encoded sha512 of the repositories created before the hash
+	// was recorded in their configuration
+	HashLegacy = &Hash{Name: "", Size: 2 * sha512.Size, new: sha2(sha512.New), hex: true}
+	HashSHA256 = &Hash{Name: "sha256", Size: sha256.Size, new: sha2(sha256.New)}
+	// Faster than SHA-256 on 64 bits hosts without SHA extensions
+	HashSHA512_256 = &Hash{Name: "sha512-256", Size: sha512.Size256, new: sha2(sha512.New512_256)}
+	// The key of keyed addresses is used as the key of BLAKE3, not through
+	// HMAC
+	HashBLAKE3 = &Hash{Name: "blake3", Size: 32, new: func(key []byte) hash.Hash {
+		return blake3.New(32, key)
+	}}
+)
+
+// DefaultHash is the hash of new repositories
+var DefaultHash = HashBLAKE3
+
+// HashNamed returns the hash recorded as name in a configuration
+func HashNamed(name string) (*Hash, error) {
+	for _, h := range []*Hash{HashLegacy, HashSHA256, HashSHA512_256, HashBLAKE3} {
+		if h.Name == name {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown hash %q", name)
+}
+
+// Sum returns the address of raw
+func (h *Hash) Sum(raw []byte) []byte {
+	return h.sum(nil, raw)
+}
+
+// KeyedSum returns the address of raw under key
+func (h *Hash) KeyedSum(key []byte, raw []byte) []byte {
+	return h.sum(key, raw)
+}
+
+func (h *Hash) sum(key []byte, raw []byte) []byte {
+	d := h.new(key)
+	d.Write(raw)
+	sum := d.Sum(nil)
+	if h.hex {
+		return []byte(hex.EncodeToString(sum))
+	}
+	return sum
+}
+
+// Whether addr is an address
+func (h *Hash) isAddr(addr []byte) bool {
+	if len(addr) != h.Size {
+		return false
+	}
+	if h.hex {
+		_, err := hex.DecodeString(string(addr))
+		return err == nil
+	}
+	return true
+}
+
+// Hex returns addr in hex, as shown to users
+func (h *Hash) Hex(addr []byte) string {
+	return string(h.key(addr))
+}
+
+// Returns the key of the object at addr in the storage. Raw addresses are
+// hex encoded: any byte could appear in them, including the '/' of the
+// paths they are sent in.
+func (h *Hash) key(addr []byte) []byte {
+	if h.hex {
+		return addr
+	}
+	return []byte(hex.EncodeToString(addr))
+}
+
+// Returns the address of the object stored at key, or nil if key is not
+// the key of an object. Any other key is either a repository object or, in
+// legacy repositories, the name of a snapshot stored before names had
+// their own namespace.
+func (h *Hash) keyAddr(key []byte) []byte {
+	if h.hex {
+		if h.isAddr(key) {
+			return key
+		}
+		return nil
+	}
+	if len(key) != 2*h.Size {
+		return nil
+	}
+	addr, err := hex.DecodeString(string(key))
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+// Config describes how a repository stores its objects
+type Config struct {
+	Hash *Hash
+}
+
+func (c *Config) Bytes() ([]byte, error) {
+	obj := [1]interface{}{c.Hash.Name}
+	return bencoded(obj)
+}
+
+func ReadConfig(data []byte) (*Config, error) {
+	var obj [1]interface{}
+	r := bytes.NewReader(data)
+	if err := bencode.Unmarshal(r, &obj); err != nil {
+		return nil, err
+	}
+	name, ok := obj[0].(string)
+	if !ok {
+		return nil, DecodeError("Hash", "Config")
+	}
+	h, err := HashNamed(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{Hash: h}, nil
+}
+
+// Stops a listing at its first key
+var errNotEmpty = errors.New("The repository is not empty")
+
+func isEmpty(s Storage) (bool, error) {
+	found := func(key []byte) error {
+		return errNotEmpty
+	}
+	for _, list := range []func([]byte, func([]byte) error) error{s.Keys, s.Refs} {
+		switch err := list(nil, found); err {
+		case nil:
+		case errNotEmpty:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// OpenConfig returns the configuration of the repository s. Repositories
+// created before it was recorded use HashLegacy. If s is empty and fresh
+// is not nil, fresh is recorded as the configuration of s.
+func OpenConfig(s Storage, fresh *Config) (*Config, error) {
+	b, err := s.Get(configKey)
+	if err == nil && len(b) == 0 {
+		err = ErrNotFound
+	}
+	switch err {
+	case nil:
+		return ReadConfig(b)
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+	legacy := &Config{Hash: HashLegacy}
+	if fresh == nil {
+		return legacy, nil
+	}
+	empty, err := isEmpty(s)
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return legacy, nil
+	}
+	if b, err = fresh.Bytes(); err != nil {
+		return nil, err
+	}
+	// Like the key file, the configuration is stored as is, so that it
+	// can be read without the passphrase
+	if err = s.Set(configKey, b); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
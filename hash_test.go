@@ -0,0 +1,182 @@
+package opi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashes(t *testing.T) {
+	raw := []byte("hello")
+	key := bytes.Repeat([]byte{1}, 32)
+	for _, h := range []*Hash{HashLegacy, HashSHA256, HashSHA512_256, HashBLAKE3} {
+		addr := h.Sum(raw)
+		if len(addr) != h.Size || !h.isAddr(addr) {
+			t.Fatalf("%q: invalid address %x", h.Name, addr)
+		}
+		keyed := h.KeyedSum(key, raw)
+		if len(keyed) != h.Size || bytes.Equal(addr, keyed) {
+			t.Fatalf("%q: invalid keyed address %x", h.Name, keyed)
+		}
+		if !bytes.Equal(h.keyAddr(h.key(addr)), addr) {
+			t.Fatalf("%q: key %q does not designate %x", h.Name, h.key(addr), addr)
+		}
+		if named, err := HashNamed(h.Name); err != nil || named != h {
+			t.Fatalf("%q: not found by name", h.Name)
+		}
+	}
+	if HashLegacy.isAddr(HashSHA256.Sum(raw)) || HashSHA256.isAddr(HashLegacy.Sum(raw)) {
+		t.Fatal("Address of another hash accepted")
+	}
+	if _, err := HashNamed("md5"); err == nil {
+		t.Fatal("Unknown hash accepted")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	// Recorded in an empty repository
+	s := newMemStorage()
+	cfg, err := OpenConfig(s, &Config{Hash: HashSHA256})
+	if err != nil || cfg.Hash != HashSHA256 {
+		t.Fatalf("Expected sha256, got %v (%v)", cfg, err)
+	}
+	if cfg, err = OpenConfig(s, nil); err != nil || cfg.Hash != HashSHA256 {
+		t.Fatalf("Configuration not recorded: %v (%v)", cfg, err)
+	}
+	if cfg, err = OpenConfig(s, &Config{Hash: HashBLAKE3}); err != nil || cfg.Hash != HashSHA256 {
+		t.Fatalf("Configuration overwritten: %v (%v)", cfg, err)
+	}
+
+	// Not in an existing one
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	s = newMemStorage()
+	if err := NewOpi(s, NewSimpleCodec()).Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = OpenConfig(s, &Config{Hash: HashBLAKE3}); err != nil || cfg.Hash != HashLegacy {
+		t.Fatalf("Expected the legacy hash, got %v (%v)", cfg, err)
+	}
+	if _, ok := s.objects[string(configKey)]; ok {
+		t.Fatal("Configuration recorded in an existing repository")
+	}
+}
+
+func TestConfigDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openDB(filepath.Join(dir, "opi.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Get(configKey); err != ErrNotFound {
+		t.Fatalf("Expected %v, got %v", ErrNotFound, err)
+	}
+	cfg, err := OpenConfig(s, &Config{Hash: HashSHA256})
+	if err != nil || cfg.Hash != HashSHA256 {
+		t.Fatalf("Expected sha256, got %v (%v)", cfg, err)
+	}
+	if cfg, err = OpenConfig(s, nil); err != nil || cfg.Hash != HashSHA256 {
+		t.Fatalf("Configuration not recorded: %v (%v)", cfg, err)
+	}
+}
+
+func TestConfiguredArchive(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	for _, h := range []*Hash{HashSHA256, HashSHA512_256, HashBLAKE3} {
+		dst, err := ioutil.TempDir("", "opi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+
+		s := newMemStorage()
+		cfg, err := OpenConfig(s, &Config{Hash: h})
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := NewOpiWith(s, NewSimpleCodec(), cfg)
+		if err := o.Archive(src, "test"); err != nil {
+			t.Fatal(err)
+		}
+		for key := range s.objects {
+			if h.keyAddr([]byte(key)) == nil && !isRepoKey([]byte(key)) {
+				t.Fatalf("%q: unexpected key %q", h.Name, key)
+			}
+		}
+		if err := o.Restore("test", dst); err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := ioutil.ReadFile(filepath.Join(src, "sub/large"))
+		actual, err := ioutil.ReadFile(filepath.Join(dst, "sub/large"))
+		if err != nil || !bytes.Equal(expected, actual) {
+			t.Fatalf("%q: restored content differs", h.Name)
+		}
+		garbage, _ := NewSimpleCodec().Encode([]byte("garbage"))
+		s.objects[strings.Repeat("0", 2*h.Size)] = garbage
+		if count, _, err := o.GC(false); err != nil || count != 1 {
+			t.Fatalf("%q: expected 1 object collected, got %d (%v)", h.Name, count, err)
+		}
+	}
+}
+
+func TestConfiguredKeyedAddresses(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	s := newMemStorage()
+	cfg, err := OpenConfig(s, &Config{Hash: HashBLAKE3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := InitEncryption(s, framed(t, CompressionSnappy), cfg, []byte("secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpiWith(s, c, cfg).(*Opi)
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	chunk, _ := NewChunk([]byte("hello")).Bytes()
+	if _, ok := s.objects[string(HashBLAKE3.key(HashBLAKE3.Sum(chunk)))]; ok {
+		t.Fatal("Unkeyed address found")
+	}
+	e, err := o.Lookup(mustTree(t, o, "test"), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HashBLAKE3.isAddr(e.Addr) {
+		t.Fatalf("Invalid address %x", e.Addr)
+	}
+	if count, _, err := o.GC(true); err != nil || count != 0 {
+		t.Fatalf("Unexpected garbage: %d, %v", count, err)
+	}
+	// The configuration is authenticated by the key file
+	if _, err := OpenEncryption(s, framed(t, CompressionSnappy), cfg, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	altered, _ := (&Config{Hash: HashSHA256}).Bytes()
+	s.objects[string(configKey)] = altered
+	if cfg, err = OpenConfig(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEncryption(s, framed(t, CompressionSnappy), cfg, []byte("secret")); err == nil {
+		t.Fatal("Altered configuration accepted")
+	}
+	delete(s.objects, string(configKey))
+	if cfg, err = OpenConfig(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEncryption(s, framed(t, CompressionSnappy), cfg, []byte("secret")); err == nil {
+		t.Fatal("Removed configuration accepted")
+	}
+}
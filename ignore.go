@@ -0,0 +1,143 @@
+package opi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Name of the files listing, like .gitignore, the files of their directory
+// that are not archived
+const ignoreFile = ".opiignore"
+
+// Directories holding this file are caches, as specified by
+// https://bford.info/cachedir/
+const (
+	cacheDirTag       = "CACHEDIR.TAG"
+	cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// An exclude pattern, with the syntax of .gitignore. Base is the directory
+// it was found in, relative to the archived directory, or "" if it applies
+// from the root.
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	base    string
+}
+
+// Patterns without a slash match at any depth below base, the others are
+// relative to base.
+func parsePattern(line string, base string) (p ignorePattern, ok bool, err error) {
+	line = strings.TrimRight(line, " \r")
+	if line == "" || line[0] == '#' {
+		return p, false, nil
+	}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	expr := "^(?:.*/)?"
+	if strings.Contains(line, "/") {
+		expr = "^"
+		line = strings.TrimPrefix(line, "/")
+	}
+	p.re, err = regexp.Compile(expr + globRegexp(line) + "$")
+	p.base = base
+	return p, err == nil, err
+}
+
+// Translates a glob to a regular expression. '*' and '?' do not match a
+// slash, '**' matches any number of directories, or anything on its own.
+func globRegexp(glob string) string {
+	if glob == "**" {
+		return ".*"
+	}
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "/**":
+			b.WriteString("/.*")
+			i += 2
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[' && strings.IndexByte(glob[i+1:], ']') > 0:
+			j := i + 1 + strings.IndexByte(glob[i+1:], ']')
+			class := glob[i+1 : j]
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i = j
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// Reads the patterns of r, one per line
+func readPatterns(r io.Reader, base string) ([]ignorePattern, error) {
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p, ok, err := parsePattern(scanner.Text(), base)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// Whether rel, relative to the archived directory, is excluded. The last
+// matching pattern decides.
+func excluded(patterns []ignorePattern, rel string, isDir bool) bool {
+	ignored := false
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		sub := rel
+		if p.base != "" {
+			if !strings.HasPrefix(rel, p.base+"/") {
+				continue
+			}
+			sub = rel[len(p.base)+1:]
+		}
+		if p.re.MatchString(sub) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// Whether dir is tagged as a cache
+func isCacheDir(dir string) bool {
+	f, err := os.Open(dir + "/" + cacheDirTag)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, int64(len(cacheDirSignature))))
+	return err == nil && bytes.Equal(b, []byte(cacheDirSignature))
+}
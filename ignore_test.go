@@ -0,0 +1,90 @@
+package opi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	rules := `
+# comment
+*.o
+!keep.o
+build/
+/top
+doc/*.html
+**/tmp/**
+sub/**/deep
+[ab].txt
+\#hash
+`
+	patterns, err := readPatterns(strings.NewReader(rules), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := readPatterns(strings.NewReader("local\n"), "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns = append(patterns, local...)
+	cases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"main.o", false, true},
+		{"src/main.o", false, true},
+		{"src/keep.o", false, false},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false},
+		{"top", false, true},
+		{"src/top", false, false},
+		{"doc/index.html", false, true},
+		{"doc/api/index.html", false, false},
+		{"a/tmp/file", false, true},
+		{"tmp/file", false, true},
+		{"sub/deep", false, true},
+		{"sub/x/y/deep", false, true},
+		{"a.txt", false, true},
+		{"c.txt", false, false},
+		{"#hash", false, true},
+		{"comment", false, false},
+		{"sub/local", false, true},
+		{"sub/x/local", false, true},
+		{"local", false, false},
+	}
+	for _, c := range cases {
+		if excluded(patterns, c.path, c.isDir) != c.excluded {
+			t.Errorf("%s: expected excluded=%v", c.path, c.excluded)
+		}
+	}
+}
+
+func TestExcludedDoubleStar(t *testing.T) {
+	patterns, err := readPatterns(strings.NewReader("a/**/b\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := readPatterns(strings.NewReader("/**\n!/keep\n"), "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns = append(patterns, local...)
+	cases := map[string]bool{
+		"a/b":         true,
+		"a/x/b":       true,
+		"a/x/y/b":     true,
+		"a/x/c":       false,
+		"x/a/b":       false,
+		"sub/x":       true,
+		"sub/x/y/z":   true,
+		"sub/keep":    false,
+		"other/x/y/z": false,
+	}
+	for path, expected := range cases {
+		if excluded(patterns, path, false) != expected {
+			t.Errorf("%s: expected excluded=%v", path, expected)
+		}
+	}
+}
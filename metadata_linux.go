@@ -0,0 +1,164 @@
+package opi
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// statExtra returns the access time, the owner and the group of a file
+func statExtra(info os.FileInfo) (atime time.Time, uid uint32, gid uint32) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime(), 0, 0
+	}
+	return time.Unix(st.Atim.Sec, st.Atim.Nsec), st.Uid, st.Gid
+}
+
+// inode returns the identity of a file, and whether it has other links
+func inode(info os.FileInfo) (id fileId, linked bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileId{}, false
+	}
+	return fileId{dev: uint64(st.Dev), ino: uint64(st.Ino)}, st.Nlink > 1
+}
+
+// deviceNumbers returns the major and minor numbers of a device
+func deviceNumbers(info os.FileInfo) (major uint32, minor uint32) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+}
+
+// mknod creates a character device, a block device or a FIFO, depending on
+// fileType
+func mknod(path string, fileType byte, major uint32, minor uint32) error {
+	mode := uint32(unix.S_IFIFO)
+	switch fileType {
+	case byte('c'):
+		mode = unix.S_IFCHR
+	case byte('b'):
+		mode = unix.S_IFBLK
+	}
+	return unix.Mknod(path, mode|0600, int(unix.Mkdev(major, minor)))
+}
+
+// dataExtents returns the ranges of f holding data, the rest of its size
+// being holes. Without support from the filesystem, the whole file is data.
+func dataExtents(f *os.File, size int64) (extents [][2]int64, err error) {
+	fd := int(f.Fd())
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		// No more data
+		if err == unix.ENXIO {
+			break
+		}
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return [][2]int64{{0, size}}, nil
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "seek", Path: f.Name(), Err: err}
+		}
+		if start >= size {
+			break
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, &os.PathError{Op: "seek", Path: f.Name(), Err: err}
+		}
+		if end > size {
+			end = size
+		}
+		extents = append(extents, [2]int64{start, end})
+		offset = end
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return extents, err
+}
+
+// lutimes sets the timestamps of path, without following symlinks. A zero
+// atime is left unchanged.
+func lutimes(path string, atime time.Time, mtime time.Time) error {
+	ts := []unix.Timespec{
+		{Nsec: unix.UTIME_OMIT},
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	if !atime.IsZero() {
+		ts[0] = unix.NsecToTimespec(atime.UnixNano())
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// listXattr returns the extended attributes of path, without following
+// symlinks
+func listXattr(path string) (*Xattr, error) {
+	x := NewXattr()
+	names, err := xattrCall(func(buf []byte) (int, error) {
+		return unix.Llistxattr(path, buf)
+	})
+	if err == unix.ENOTSUP {
+		return x, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := xattrCall(func(buf []byte) (int, error) {
+			return unix.Lgetxattr(path, name, buf)
+		})
+		// The attribute may have been removed in the meantime
+		if err == unix.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		x.Set(name, value)
+	}
+	return x, nil
+}
+
+// Calls f with a buffer large enough for its result. The size is queried
+// first, but it may grow before the actual call.
+func xattrCall(f func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := f(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = f(buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+// isNotSupported tells whether err means that the filesystem does not
+// support the operation
+func isNotSupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// setXattr sets an extended attribute of path, without following symlinks
+func setXattr(path string, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
@@ -0,0 +1,295 @@
+package opi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRestoreXattr(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	err = unix.Setxattr(filepath.Join(src, "small"), "user.opi", []byte("value"), 0)
+	if err == unix.ENOTSUP {
+		t.Skip("extended attributes not supported")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	x, err := listXattr(filepath.Join(dst, "small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(x.Attributes["user.opi"]) != "value" {
+		t.Fatalf("Extended attribute not restored: %v", x.Attributes)
+	}
+}
+
+func TestRestoreACL(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	acl := ACL{
+		{Tag: ACLUserObj, Perm: 6},
+		{Tag: ACLUser, Perm: 4, Id: 1234},
+		{Tag: ACLGroupObj, Perm: 4},
+		{Tag: ACLMask, Perm: 4},
+		{Tag: ACLOther, Perm: 4},
+	}
+	err = unix.Setxattr(filepath.Join(src, "small"), aclAccessXattr, acl.XattrValue(), 0)
+	if err == unix.ENOTSUP {
+		t.Skip("ACLs not supported")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpi(newMemStorage(), NewSimpleCodec()).(*Opi)
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := o.TreeOf("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := o.Lookup(tree, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ACL.String() != "user::rw-,user:1234:r--,group::r--,mask::r--,other::r--" {
+		t.Fatalf("Unexpected ACL %s", e.ACL)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	x, err := listXattr(filepath.Join(dst, "small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ParseACLXattr(x.Attributes[aclAccessXattr])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.String() != acl.String() {
+		t.Fatalf("Expected ACL %s, got %s", acl, restored)
+	}
+}
+
+func TestRestoreAtime(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	atime := time.Date(1999, 12, 31, 23, 59, 59, 0, time.UTC)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "small"), atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if _, err := o.ArchiveWith(src, "test", ArchiveOptions{RecordAtime: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored, _, _ := statExtra(info); !restored.Equal(atime) {
+		t.Fatalf("Expected atime %v, got %v", atime, restored)
+	}
+}
+
+func TestRestoreHardlink(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err := os.Link(filepath.Join(src, "sub/large"), filepath.Join(src, "twin")); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	first, err := os.Stat(filepath.Join(dst, "sub/large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.Stat(filepath.Join(dst, "twin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(first, second) {
+		t.Fatal("Hardlink restored as a separate file")
+	}
+	// Without its target, the content is written again
+	if err := o.RestorePath("test", "twin", filepath.Join(dst, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := ioutil.ReadFile(filepath.Join(src, "twin"))
+	actual, err := ioutil.ReadFile(filepath.Join(dst, "copy"))
+	if err != nil || string(expected) != string(actual) {
+		t.Fatal("Incorrect file restored")
+	}
+}
+
+func TestRestoreSpecialFiles(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err := unix.Mkfifo(filepath.Join(src, "fifo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(src, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Only root may create devices
+	privileged := os.Getuid() == 0
+	if privileged {
+		err := unix.Mknod(filepath.Join(src, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	skipped, err := o.ArchiveWith(src, "test", ArchiveOptions{RecordSkipped: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].Path != "socket" {
+		t.Fatalf("Expected the socket skipped, got %v", skipped)
+	}
+	var recorded []SkippedFile
+	err = o.History("test", func(addr []byte, c *Commit) error {
+		recorded = c.Skipped
+		return nil
+	})
+	if err != nil || len(recorded) != 1 || recorded[0].Path != "socket" {
+		t.Fatalf("Expected the socket recorded, got %v (%v)", recorded, err)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(dst, "fifo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != os.ModeNamedPipe|0640 {
+		t.Fatalf("Incorrect FIFO restored: %v", info.Mode())
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "socket")); !os.IsNotExist(err) {
+		t.Fatal("Socket should not be restored")
+	}
+	if privileged {
+		info, err := os.Lstat(filepath.Join(dst, "null"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		major, minor := deviceNumbers(info)
+		if info.Mode()&os.ModeCharDevice == 0 || major != 1 || minor != 3 {
+			t.Fatalf("Incorrect device restored: %v %d:%d", info.Mode(), major, minor)
+		}
+	}
+}
+
+func TestRestoreSparse(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// Data between two holes
+	const size = 16 << 20
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(RandomBytes(), size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if allocated(t, filepath.Join(src, "sparse")) >= size {
+		t.Skip("sparse files not supported")
+	}
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := ioutil.ReadFile(filepath.Join(src, "sparse"))
+	actual, err := ioutil.ReadFile(filepath.Join(dst, "sparse"))
+	if err != nil || !bytes.Equal(expected, actual) {
+		t.Fatal("Incorrect file restored")
+	}
+	if allocated(t, filepath.Join(dst, "sparse")) >= size {
+		t.Fatal("Restored file is not sparse")
+	}
+	// Holes are written as zeros to streams
+	var b bytes.Buffer
+	if err := o.Cat("test", "sparse", &b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, b.Bytes()) {
+		t.Fatal("Incorrect content")
+	}
+}
+
+// Space allocated to the file at path
+func allocated(t *testing.T, path string) int64 {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks * 512
+}
@@ -0,0 +1,74 @@
+//go:build !linux
+// +build !linux
+
+package opi
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// statExtra returns the access time, the owner and the group of a file.
+// They are not portably available, the modification time stands for the
+// access time.
+func statExtra(info os.FileInfo) (atime time.Time, uid uint32, gid uint32) {
+	return info.ModTime(), 0, 0
+}
+
+// inode returns the identity of a file, and whether it has other links.
+// Links are not detected outside Linux.
+func inode(info os.FileInfo) (id fileId, linked bool) {
+	return fileId{}, false
+}
+
+// deviceNumbers returns the major and minor numbers of a device. They are
+// not portably available.
+func deviceNumbers(info os.FileInfo) (major uint32, minor uint32) {
+	return 0, 0
+}
+
+// mknod creates a character device, a block device or a FIFO. Only Linux is
+// supported.
+func mknod(path string, fileType byte, major uint32, minor uint32) error {
+	return errors.New("Special files are not supported on this platform")
+}
+
+// dataExtents returns the ranges of f holding data. Holes are only detected
+// on Linux, elsewhere the whole file is data.
+func dataExtents(f *os.File, size int64) (extents [][2]int64, err error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return [][2]int64{{0, size}}, nil
+}
+
+// lutimes sets the timestamps of path, except for symlinks, which cannot
+// be portably modified without following them. A zero atime is left
+// unchanged.
+func lutimes(path string, atime time.Time, mtime time.Time) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+// listXattr returns the extended attributes of path. Only Linux is
+// supported, there are none elsewhere.
+func listXattr(path string) (*Xattr, error) {
+	return NewXattr(), nil
+}
+
+// isNotSupported tells whether err means that the filesystem does not
+// support the operation
+func isNotSupported(err error) bool {
+	return false
+}
+
+func setXattr(path string, name string, value []byte) error {
+	return nil
+}
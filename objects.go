@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"time"
 
 	bencode "github.com/jackpal/bencode-go"
@@ -107,59 +108,285 @@ func NewSuperChunk() *SuperChunk {
 	return &SuperChunk{}
 }
 
+// Hole
+
+// A range of a sparse file holding no data, read as zeros
+type Hole struct {
+	Length uint64
+}
+
+func (h *Hole) Bytes() ([]byte, error) {
+	obj := [1]interface{}{int64(h.Length)}
+	return bencoded(obj)
+}
+
+func NewHole(length uint64) *Hole {
+	return &Hole{Length: length}
+}
+
+func ReadHole(data []byte) (*Hole, error) {
+	var obj [1]interface{}
+	r := bytes.NewReader(data)
+	if err := bencode.Unmarshal(r, &obj); err != nil {
+		return nil, err
+	}
+	length, ok := obj[0].(int64)
+	if !ok || length < 0 {
+		return nil, DecodeError("Length", "Hole")
+	}
+	return NewHole(uint64(length)), nil
+}
+
 // Xattr
 
+// Extended attributes of a file, by name
 type Xattr struct {
-	attributes map[string]string
+	Attributes map[string][]byte
+}
+
+func (x *Xattr) Set(name string, value []byte) {
+	x.Attributes[name] = value
+}
+
+// bencode dictionaries have sorted keys: equal attributes give equal
+// objects, shared by all the files that carry them
+func (x *Xattr) Bytes() ([]byte, error) {
+	obj := make(map[string]string)
+	for name, value := range x.Attributes {
+		obj[name] = string(value)
+	}
+	return bencoded(obj)
+}
+
+func NewXattr() *Xattr {
+	return &Xattr{Attributes: make(map[string][]byte)}
+}
+
+func ReadXattr(data []byte) (*Xattr, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, DecodeError("Attributes", "Xattr")
+	}
+	x := NewXattr()
+	for name, v := range obj {
+		value, ok := v.(string)
+		if !ok {
+			return nil, DecodeError("Attributes", "Xattr")
+		}
+		x.Set(name, []byte(value))
+	}
+	return x, nil
+}
+
+// Device
+
+// A character or block device, with its major and minor numbers. FIFOs are
+// recorded as a device without numbers.
+type Device struct {
+	Major uint32
+	Minor uint32
+}
+
+func (d *Device) Bytes() ([]byte, error) {
+	obj := [2]interface{}{int64(d.Major), int64(d.Minor)}
+	return bencoded(obj)
+}
+
+func NewDevice(major uint32, minor uint32) *Device {
+	return &Device{Major: major, Minor: minor}
+}
+
+func ReadDevice(data []byte) (*Device, error) {
+	var obj [2]interface{}
+	r := bytes.NewReader(data)
+	if err := bencode.Unmarshal(r, &obj); err != nil {
+		return nil, err
+	}
+	major, ok := obj[0].(int64)
+	if !ok {
+		return nil, DecodeError("Major", "Device")
+	}
+	minor, ok := obj[1].(int64)
+	if !ok {
+		return nil, DecodeError("Minor", "Device")
+	}
+	return NewDevice(uint32(major), uint32(minor)), nil
+}
+
+// Hardlink
+
+// A file linked to another one, found before it in the same snapshot.
+// Target is the path of that file, relative to the root of the snapshot.
+// MetaType and Addr designate their common content.
+type Hardlink struct {
+	Target   string
+	MetaType byte
+	Addr     []byte
+}
+
+func (h *Hardlink) Bytes() ([]byte, error) {
+	obj := [3]interface{}{h.Target, h.MetaType, h.Addr}
+	return bencoded(obj)
+}
+
+func NewHardlink(target string, metaType byte, addr []byte) *Hardlink {
+	return &Hardlink{Target: target, MetaType: metaType, Addr: addr}
+}
+
+func ReadHardlink(data []byte) (*Hardlink, error) {
+	var obj [3]interface{}
+	r := bytes.NewReader(data)
+	if err := bencode.Unmarshal(r, &obj); err != nil {
+		return nil, err
+	}
+	target, ok := obj[0].(string)
+	if !ok {
+		return nil, DecodeError("Target", "Hardlink")
+	}
+	metaType, ok := obj[1].(int64)
+	if !ok {
+		return nil, DecodeError("MetaType", "Hardlink")
+	}
+	addr, ok := obj[2].(string)
+	if !ok {
+		return nil, DecodeError("Addr", "Hardlink")
+	}
+	return NewHardlink(target, byte(metaType), []byte(addr)), nil
 }
 
 // Dir
 
+// Size of the entries read from directory objects written before the size
+// was recorded
+const UnknownSize = ^uint64(0)
+
+// Entries read from directory objects written before the ownership and the
+// timestamps were recorded have a zero Mtime. Atime is zero unless it was
+// asked for. Mode holds the permissions and the setuid, setgid and sticky
+// bits, with their values in st_mode. Xattr is the address of the
+// extended attributes of the file, empty if it has none. Older directory
+// objects hold a placeholder instead. The POSIX ACLs are not part of the
+// extended attributes, they are decoded in ACL and DefaultACL.
 type DirEntry struct {
-	FileType byte
-	Mode     uint32
-	Name     []byte
-	Xattr    []byte
-	Addr     []byte
+	FileType   byte
+	Mode       uint32
+	Name       []byte
+	Xattr      []byte
+	Addr       []byte
+	Size       uint64
+	Mtime      time.Time
+	Atime      time.Time
+	Uid        uint32
+	Gid        uint32
+	ACL        ACL
+	DefaultACL ACL
 }
 
-func (d *Dir) AddEntry(fileType byte, mode uint32, name []byte, xattr []byte, addr []byte) {
-	entry := DirEntry{
+func (d *Dir) AddEntry(fileType byte, mode uint32, name []byte, xattr []byte, addr []byte, size uint64) {
+	d.Add(DirEntry{
 		FileType: fileType,
 		Mode:     mode,
 		Name:     name,
 		Xattr:    xattr,
 		Addr:     addr,
-	}
-	d.Entries = append(d.Entries, entry)
+		Size:     size,
+	})
+}
+
+func (d *Dir) Add(e DirEntry) {
+	d.Entries = append(d.Entries, e)
 }
 
 type Dir struct {
 	Entries []DirEntry
 }
 
+// Timestamps are stored as nanoseconds since the epoch. The zero time,
+// which has no such representation, is stored as the smallest int64.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == math.MinInt64 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// ACLs are stored as lists of (tag, perm, id)
+func aclObj(a ACL) [][3]interface{} {
+	obj := [][3]interface{}{}
+	for _, e := range a {
+		obj = append(obj, [3]interface{}{e.Tag, e.Perm, e.Id})
+	}
+	return obj
+}
+
+func readACL(obj interface{}) (ACL, error) {
+	l, ok := obj.([]interface{})
+	if !ok {
+		return nil, DecodeError("ACL", "Dir")
+	}
+	var a ACL
+	for _, i := range l {
+		e, ok := i.([]interface{})
+		if !ok || len(e) != 3 {
+			return nil, DecodeError("ACL", "Dir")
+		}
+		tag, ok1 := e[0].(int64)
+		perm, ok2 := e[1].(int64)
+		id, ok3 := e[2].(int64)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, DecodeError("ACL", "Dir")
+		}
+		a = append(a, ACLEntry{Tag: uint16(tag), Perm: uint16(perm), Id: uint32(id)})
+	}
+	return a, nil
+}
+
 func (d *Dir) Bytes() ([]byte, error) {
-	var obj [][5]interface{}
+	var obj [][12]interface{}
 	for _, e := range d.Entries {
-		obj = append(obj, [5]interface{}{
+		obj = append(obj, [12]interface{}{
 			e.FileType,
 			e.Mode,
 			e.Name,
 			e.Xattr,
 			e.Addr,
+			e.Size,
+			unixNano(e.Mtime),
+			unixNano(e.Atime),
+			e.Uid,
+			e.Gid,
+			aclObj(e.ACL),
+			aclObj(e.DefaultACL),
 		})
 	}
 	return bencoded(obj)
 }
 
+// Entries have 12 fields. Directory objects written before the size was
+// recorded have 5 of them, 6 before the ownership and the timestamps were
+// recorded, and 10 before the ACLs were.
 func ReadDir(data []byte) (*Dir, error) {
-	var obj [][5]interface{}
+	var obj [][]interface{}
 	r := bytes.NewReader(data)
 	if err := bencode.Unmarshal(r, &obj); err != nil {
 		return nil, err
 	}
 	d := NewDir()
 	for _, e := range obj {
+		if len(e) != 5 && len(e) != 6 && len(e) != 10 && len(e) != 12 {
+			return nil, DecodeError("Entry", "Dir")
+		}
 		fileType, ok := e[0].(int64)
 		if !ok {
 			return nil, DecodeError("FileType", "Dir")
@@ -180,13 +407,53 @@ func ReadDir(data []byte) (*Dir, error) {
 		if !ok {
 			return nil, DecodeError("Addr", "Dir")
 		}
-		d.AddEntry(
-			byte(fileType),
-			uint32(mode),
-			[]byte(name),
-			[]byte(xattr),
-			[]byte(addr),
-		)
+		entry := DirEntry{
+			FileType: byte(fileType),
+			Mode:     uint32(mode),
+			Name:     []byte(name),
+			Xattr:    []byte(xattr),
+			Addr:     []byte(addr),
+			Size:     UnknownSize,
+		}
+		if len(e) > 5 {
+			size, ok := e[5].(int64)
+			if !ok || size < 0 {
+				return nil, DecodeError("Size", "Dir")
+			}
+			entry.Size = uint64(size)
+		}
+		if len(e) > 6 {
+			mtime, ok := e[6].(int64)
+			if !ok {
+				return nil, DecodeError("Mtime", "Dir")
+			}
+			atime, ok := e[7].(int64)
+			if !ok {
+				return nil, DecodeError("Atime", "Dir")
+			}
+			uid, ok := e[8].(int64)
+			if !ok {
+				return nil, DecodeError("Uid", "Dir")
+			}
+			gid, ok := e[9].(int64)
+			if !ok {
+				return nil, DecodeError("Gid", "Dir")
+			}
+			entry.Mtime = fromUnixNano(mtime)
+			entry.Atime = fromUnixNano(atime)
+			entry.Uid = uint32(uid)
+			entry.Gid = uint32(gid)
+		}
+		if len(e) > 10 {
+			var err error
+			if entry.ACL, err = readACL(e[10]); err != nil {
+				return nil, err
+			}
+			if entry.DefaultACL, err = readACL(e[11]); err != nil {
+				return nil, err
+			}
+		}
+		d.Add(entry)
 	}
 	return d, nil
 }
@@ -197,31 +464,48 @@ func NewDir() *Dir {
 
 // Commit
 
+// A file left out of a snapshot, with the error met while reading it. Path
+// is relative to the root of the snapshot.
+type SkippedFile struct {
+	Path   string
+	Reason string
+}
+
 type Commit struct {
 	Date    time.Time
 	Tree    []byte
 	Host    []byte
 	Replica []byte
 	Parents [][]byte
+	Skipped []SkippedFile
 }
 
 func (c *Commit) Bytes() ([]byte, error) {
-	obj := [5]interface{}{
+	skipped := [][2]interface{}{}
+	for _, s := range c.Skipped {
+		skipped = append(skipped, [2]interface{}{s.Path, s.Reason})
+	}
+	obj := [6]interface{}{
 		c.Date.Format(time.UnixDate),
 		c.Tree,
 		c.Host,
 		c.Replica,
 		c.Parents,
+		skipped,
 	}
 	return bencoded(obj)
 }
 
+// Commits written before the skipped files were recorded have 5 fields
 func ReadCommit(data []byte) (*Commit, error) {
-	var obj [5]interface{}
+	var obj []interface{}
 	r := bytes.NewReader(data)
 	if err := bencode.Unmarshal(r, &obj); err != nil {
 		return nil, err
 	}
+	if len(obj) != 5 && len(obj) != 6 {
+		return nil, DecodeError("Fields", "Commit")
+	}
 	fmtdate, ok := obj[0].(string)
 	if !ok {
 		return nil, DecodeError("Date", "Commit")
@@ -243,11 +527,16 @@ func ReadCommit(data []byte) (*Commit, error) {
 		return nil, DecodeError("Replica", "Commit")
 	}
 	parents := [][]byte{}
-	p, ok := obj[4].([]string)
-	if ok {
-		for _, s := range p {
-			parents = append(parents, []byte(s))
+	p, ok := obj[4].([]interface{})
+	if !ok {
+		return nil, DecodeError("Parents", "Commit")
+	}
+	for _, i := range p {
+		s, ok := i.(string)
+		if !ok {
+			return nil, DecodeError("Parents", "Commit")
 		}
+		parents = append(parents, []byte(s))
 	}
 	c := NewCommit(
 		d,
@@ -256,6 +545,24 @@ func ReadCommit(data []byte) (*Commit, error) {
 		[]byte(replica),
 		parents,
 	)
+	if len(obj) > 5 {
+		l, ok := obj[5].([]interface{})
+		if !ok {
+			return nil, DecodeError("Skipped", "Commit")
+		}
+		for _, i := range l {
+			s, ok := i.([]interface{})
+			if !ok || len(s) != 2 {
+				return nil, DecodeError("Skipped", "Commit")
+			}
+			path, ok1 := s[0].(string)
+			reason, ok2 := s[1].(string)
+			if !ok1 || !ok2 {
+				return nil, DecodeError("Skipped", "Commit")
+			}
+			c.Skipped = append(c.Skipped, SkippedFile{Path: path, Reason: reason})
+		}
+	}
 	return c, nil
 }
 
@@ -264,7 +571,8 @@ func (c *Commit) AddParent(addr []byte) {
 }
 
 func NewCommit(date time.Time, tree []byte, host []byte, replica []byte, parents [][]byte) *Commit {
-	d, _ := time.Parse(date.Format(time.UnixDate), time.UnixDate)
+	// Round the date the way it is serialized
+	d, _ := time.Parse(time.UnixDate, date.Format(time.UnixDate))
 	return &Commit{
 		Date:    d,
 		Tree:    tree,
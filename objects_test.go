@@ -124,6 +124,21 @@ func DirsEqual(d1, d2 *Dir) bool {
 		if !bytes.Equal(e1.Xattr, e2.Xattr) {
 			return false
 		}
+		if e1.Size != e2.Size {
+			return false
+		}
+		if !e1.Mtime.Equal(e2.Mtime) || !e1.Atime.Equal(e2.Atime) {
+			return false
+		}
+		if e1.Uid != e2.Uid || e1.Gid != e2.Gid {
+			return false
+		}
+		if !reflect.DeepEqual(e1.ACL, e2.ACL) {
+			return false
+		}
+		if !reflect.DeepEqual(e1.DefaultACL, e2.DefaultACL) {
+			return false
+		}
 	}
 	return true
 }
@@ -136,7 +151,22 @@ func TestDir(t *testing.T) {
 		[]byte("small file"),
 		[]byte("small file addr"),
 		[]byte("small file xattr addr"),
+		10,
 	)
+	d.Add(DirEntry{
+		FileType: byte('d'),
+		Mode:     0755,
+		Name:     []byte("dir"),
+		Addr:     []byte("dir addr"),
+		Mtime:    time.Unix(1234567890, 123456789),
+		Atime:    time.Unix(0, 0),
+		Uid:      1000,
+		Gid:      100,
+		DefaultACL: ACL{
+			{Tag: ACLUserObj, Perm: 7},
+			{Tag: ACLGroup, Perm: 5, Id: 100},
+		},
+	})
 	b, err := d.Bytes()
 	if err != nil {
 		t.Fatal(err)
@@ -150,6 +180,22 @@ func TestDir(t *testing.T) {
 	}
 }
 
+func TestDirWithoutSize(t *testing.T) {
+	b, err := bencoded([][5]interface{}{
+		{byte('C'), 0644, "small file", "xattr", "small file addr"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ReadDir(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Entries) != 1 || d.Entries[0].Size != UnknownSize {
+		t.Fatal("Incorrect decoding of a directory without sizes")
+	}
+}
+
 func CommitsEqual(c1, c2 *Commit) bool {
 	if c1 == nil || c2 == nil {
 		return false
@@ -198,6 +244,66 @@ func TestCommit(t *testing.T) {
 	}
 }
 
+func TestCommitParents(t *testing.T) {
+	c := NewCommit(
+		time.Now(),
+		[]byte("tree"),
+		[]byte("host"),
+		[]byte("replica"),
+		nil,
+	)
+	c.AddParent([]byte("parent1"))
+	c.AddParent([]byte("parent2"))
+	b, err := c.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRes, err := ReadCommit(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CommitsEqual(c, readRes) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+}
+
+func TestXattr(t *testing.T) {
+	x := NewXattr()
+	x.Set("user.comment", []byte("hello"))
+	x.Set("security.selinux", []byte("system_u:object_r:etc_t:s0\x00"))
+	b, err := x.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRes, err := ReadXattr(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(x, readRes) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+}
+
+func TestACLXattr(t *testing.T) {
+	a := ACL{
+		{Tag: ACLUserObj, Perm: 7},
+		{Tag: ACLUser, Perm: 5, Id: 1000},
+		{Tag: ACLGroupObj, Perm: 5},
+		{Tag: ACLMask, Perm: 5},
+		{Tag: ACLOther, Perm: 0},
+	}
+	readRes, err := ParseACLXattr(a.XattrValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readRes.String() != "user::rwx,user:1000:r-x,group::r-x,mask::r-x,other::---" {
+		t.Fatalf("Incorrect back and forth convertion: %s\n", readRes)
+	}
+	if _, err := ParseACLXattr([]byte{2, 0, 0, 0, 1}); err == nil {
+		t.Fatal("Expected an error for a truncated ACL")
+	}
+}
+
 func TestSymlink(t *testing.T) {
 	s := NewSymlink("target")
 	b, _ := s.Bytes()
@@ -206,3 +312,64 @@ func TestSymlink(t *testing.T) {
 		t.Fatal("Incorrect back and forth convertion\n")
 	}
 }
+
+func TestHardlink(t *testing.T) {
+	h := NewHardlink("sub/file", byte('S'), []byte("addr"))
+	b, err := h.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRes, err := ReadHardlink(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, readRes) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+}
+
+func TestDevice(t *testing.T) {
+	d := NewDevice(8, 1)
+	b, err := d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRes, err := ReadDevice(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, readRes) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+}
+
+func TestHole(t *testing.T) {
+	h := NewHole(1 << 40)
+	b, err := h.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRes, err := ReadHole(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, readRes) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+}
+
+func TestCommitSkipped(t *testing.T) {
+	c := NewCommit(time.Now(), []byte("tree"), []byte("host"), []byte("replica"), nil)
+	c.Skipped = []SkippedFile{{Path: "sub/file", Reason: "permission denied"}}
+	b, err := c.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRes, err := ReadCommit(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CommitsEqual(c, readRes) || !reflect.DeepEqual(c.Skipped, readRes.Skipped) {
+		t.Fatal("Incorrect back and forth convertion\n")
+	}
+}
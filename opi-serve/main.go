@@ -6,13 +6,22 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os/user"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/chmduquesne/opi"
 )
 
+const (
+	// Number of keys per page of the listing
+	pageSize = 1000
+	// Snapshot names are served under this prefix
+	refsPrefix = "refs/"
+)
+
 type Storage struct {
 	db         *bolt.DB
 	bucketName []byte
@@ -32,12 +41,18 @@ func NewStorage() *Storage {
 	return &Storage{db: db, bucketName: []byte("objects")}
 }
 
+// Bucket returns a Storage sharing the same db, but working on another
+// bucket
+func (s *Storage) Bucket(name string) *Storage {
+	return &Storage{db: s.db, bucketName: []byte(name)}
+}
+
 func (s *Storage) Close() error {
 	return s.db.Close()
 }
 
 func (s *Storage) Set(key, value []byte) error {
-	go s.db.Batch(func(tx *bolt.Tx) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(s.bucketName)
 		if err != nil {
 			return err
@@ -48,7 +63,6 @@ func (s *Storage) Set(key, value []byte) error {
 		}
 		return nil
 	})
-	return nil
 }
 
 func (s *Storage) Get(key []byte) (value []byte, err error) {
@@ -65,14 +79,75 @@ func (s *Storage) Get(key []byte) (value []byte, err error) {
 	return
 }
 
+func (s *Storage) Hit(key []byte) (found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucketName)
+		found = bucket != nil && bucket.Get(key) != nil
+		return nil
+	})
+	return
+}
+
+func (s *Storage) Del(key []byte) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// Keys returns at most limit keys starting with prefix, located strictly
+// after the key after.
+func (s *Storage) Keys(prefix, after []byte, limit int) (keys [][]byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucketName)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k, _ := c.Seek(prefix)
+		if bytes.Compare(after, prefix) >= 0 {
+			k, _ = c.Seek(after)
+			if bytes.Equal(k, after) {
+				k, _ = c.Next()
+			}
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(keys) < limit; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	return
+}
+
 func main() {
-	s := NewStorage()
-	defer s.Close()
+	objects := NewStorage()
+	defer objects.Close()
+	refs := objects.Bucket("refs")
 
 	handler := func(w http.ResponseWriter, r *http.Request) {
+		s := objects
 		key := r.URL.Path[1:] // remove the '/' prefix
+		// snapshot names are stored apart from the objects
+		if strings.HasPrefix(key, refsPrefix) {
+			s = refs
+			key = key[len(refsPrefix):]
+		}
 		//log.Printf("%v %v", r.Method, r.URL.Path)
 		switch {
+		case r.Method == "GET" && key == "":
+			q := r.URL.Query()
+			keys, err := s.Keys([]byte(q.Get("prefix")), []byte(q.Get("after")), pageSize)
+			if err != nil {
+				log.Printf("listing: %v", err)
+				w.WriteHeader(500)
+				return
+			}
+			for _, k := range keys {
+				fmt.Fprintln(w, url.QueryEscape(string(k)))
+			}
 		case r.Method == "GET":
 			value, err := s.Get([]byte(key))
 			if err != nil || value == nil {
@@ -80,10 +155,27 @@ func main() {
 			} else {
 				w.Write(value)
 			}
+		case r.Method == "HEAD":
+			found, err := s.Hit([]byte(key))
+			switch {
+			case err != nil:
+				w.WriteHeader(500)
+			case !found:
+				w.WriteHeader(404)
+			}
 		case r.Method == "POST":
 			value, err := ioutil.ReadAll(r.Body)
-			err = s.Set([]byte(key), []byte(value))
+			if err == nil {
+				err = s.Set([]byte(key), []byte(value))
+			}
+			if err != nil {
+				log.Printf("%s: %v", key, err)
+				w.WriteHeader(500)
+			}
+		case r.Method == "DELETE":
+			err := s.Del([]byte(key))
 			if err != nil {
+				log.Printf("%s: %v", key, err)
 				w.WriteHeader(500)
 			}
 		default:
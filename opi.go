@@ -2,13 +2,15 @@ package opi
 
 import (
 	"bufio"
-	"crypto/sha512"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
@@ -38,52 +40,165 @@ type storedMetaChunk struct {
 	metatype byte
 }
 
+// Identity of a file on the host
+type fileId struct {
+	dev uint64
+	ino uint64
+}
+
+// A file having several links, as first met during a snapshot
+type linkedFile struct {
+	link *Hardlink
+	size uint64
+}
+
 type Opi struct {
 	Storage
 	Codec
+	hash    *Hash
 	writers chan bool
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+}
+
+// The state of an archive, so that several can run concurrently
+type archiver struct {
+	*Opi
+	// The archived directory and the files having several links found in
+	// it, nil to leave them undetected
+	root  string
+	links map[fileId]linkedFile
+	// The options, the files skipped so far and the exclude patterns
+	// applying to the current directory
+	options  ArchiveOptions
+	skipped  []SkippedFile
+	patterns []ignorePattern
+}
+
+// The state of a restore: the path restored from the snapshot and its
+// destination, where the targets of hardlinks are found, and its options
+type restorer struct {
+	*Opi
+	from    string
+	to      string
+	options RestoreOptions
 }
 
+// NewOpi returns a Timeline on a repository created before its
+// configuration was recorded
 func NewOpi(s Storage, c Codec) Timeline {
+	return NewOpiWith(s, c, &Config{Hash: HashLegacy})
+}
+
+// NewOpiWith returns a Timeline on a repository configured by cfg, as
+// returned by OpenConfig
+func NewOpiWith(s Storage, c Codec, cfg *Config) Timeline {
 	return &Opi{
 		Storage: s,
 		Codec:   c,
+		hash:    cfg.Hash,
 		writers: make(chan bool, maxWriters),
 	}
 }
 
-// Wrap Storage.Set to do things concurrently. If an error occurs, a panic
-// is generated and must be recovered by the caller in order to exit
-// cleanly.
+// Returns an Opi sharing the limit on concurrent writes with o, but
+// waiting for and reporting the errors of its own writes only
+func (o *Opi) fork() *Opi {
+	return &Opi{
+		Storage: o.Storage,
+		Codec:   o.Codec,
+		hash:    o.hash,
+		writers: o.writers,
+	}
+}
+
+// Wrap Storage.Set to do things concurrently. At most maxWriters writes
+// are in flight at any time. Errors are not returned here: the first one
+// is kept and reported by Flush.
 func (o *Opi) Set(key []byte, value []byte) {
+	o.writers <- true
+	o.pending.Add(1)
+	go func() {
+		defer func() {
+			<-o.writers
+			o.pending.Done()
+		}()
+		if err := o.Storage.Set(key, value); err != nil {
+			o.setErr(err)
+		}
+	}()
+}
+
+func (o *Opi) setErr(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err == nil {
+		o.err = err
+	}
+}
+
+// Err returns the first error reported by a concurrent write, if any.
+func (o *Opi) Err() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
 }
 
-//func (o *Opi) Set(key []byte, value []byte) {
-//	o.writers <- true
-//	go func() {
-//		defer func() { <-o.writers }()
-//		if err := o.Storage.Set(key, value); err != nil {
-//			panic(err)
-//		}
-//	}()
-//}
+// Flush waits until all the pending writes are done, and returns the first
+// error that occurred since the previous Flush.
+func (o *Opi) Flush() error {
+	o.pending.Wait()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.err
+	o.err = nil
+	return err
+}
 
 func (o *Opi) Serialize(f FSObject) ([]byte, error) {
 	value, err := f.Bytes()
 	if err != nil {
 		return nil, err
 	}
-	addr := []byte(fmt.Sprintf("%x", sha512.Sum512(value)))
+	// Stop early if a previous write failed
+	if err := o.Err(); err != nil {
+		return nil, err
+	}
+	addr := o.address(value)
+	// Content addressed: if the address is known, so is the content
+	key := o.hash.key(addr)
+	switch err := o.Hit(key); err {
+	case nil:
+		return addr, nil
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
 	encoded, err := o.Encode(value)
 	if err != nil {
 		return nil, err
 	}
-	o.Set(addr, encoded)
+	o.Set(key, encoded)
 	return addr, nil
 }
 
+func (o *Opi) address(value []byte) []byte {
+	if a, ok := o.Codec.(Addresser); ok {
+		return a.Address(value)
+	}
+	return o.hash.Sum(value)
+}
+
+// ErrCorrupt is returned when an object read from the storage is not the
+// one its address designates
+var ErrCorrupt = errors.New("Object does not match its address")
+
+// DeSerialize returns the object stored at addr. Encrypted objects are
+// authentic, but the storage could still serve one in place of another:
+// the address is checked too.
 func (o *Opi) DeSerialize(addr []byte) (value []byte, err error) {
-	encoded, err := o.Get(addr)
+	encoded, err := o.Get(o.hash.key(addr))
 	if err != nil {
 		return nil, err
 	}
@@ -91,10 +206,13 @@ func (o *Opi) DeSerialize(addr []byte) (value []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if !bytes.Equal(o.address(value), addr) {
+		return nil, ErrCorrupt
+	}
 	return value, nil
 }
 
-func (o *Opi) Slice(path string) (addr []byte, filetype byte, err error) {
+func (o *Opi) Slice(path string) (addr []byte, filetype byte, size uint64, err error) {
 	var f *os.File
 	if f, err = os.Open(path); err != nil {
 		return
@@ -104,15 +222,64 @@ func (o *Opi) Slice(path string) (addr []byte, filetype byte, err error) {
 			err = errClose
 		}
 	}()
-	stream := fwd.NewReader(f)
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	extents, err := dataExtents(f, info.Size())
+	if err != nil {
+		return
+	}
 	t := time.Now()
-	n, addr, filetype, _, err := o.SliceUntil(stream, topMask)
+	var n uint64
+	if len(extents) == 0 && info.Size() == 0 || len(extents) == 1 && extents[0] == [2]int64{0, info.Size()} {
+		n, addr, filetype, _, err = o.SliceUntil(fwd.NewReader(f), topMask)
+	} else {
+		n, addr, filetype, err = o.sliceSparse(f, extents, uint64(info.Size()))
+	}
 	d := time.Since(t)
 	fmt.Printf("%s %s (%s/s)\n", path, bytefmt.ByteSize(n), bytefmt.ByteSize(uint64(float64(n)/d.Seconds())))
 	if err == io.EOF {
 		err = nil
 	}
-	return addr, filetype, err
+	return addr, filetype, n, err
+}
+
+// The ranges of a sparse file holding data are sliced separately, the holes
+// between them are recorded with their length only.
+func (o *Opi) sliceSparse(f *os.File, extents [][2]int64, size uint64) (n uint64, addr []byte, filetype byte, err error) {
+	s := NewSuperChunk()
+	for _, e := range extents {
+		if uint64(e[0]) > n {
+			if err = o.addHole(s, n, uint64(e[0])-n); err != nil {
+				return
+			}
+		}
+		stream := fwd.NewReader(io.NewSectionReader(f, e[0], e[1]-e[0]))
+		m, addr, metatype, _, err := o.SliceUntil(stream, topMask)
+		if err != nil && err != io.EOF {
+			return n, nil, 0, err
+		}
+		s.AddChild(uint64(e[0]), metatype, addr)
+		n = uint64(e[0]) + m
+	}
+	if size > n {
+		if err = o.addHole(s, n, size-n); err != nil {
+			return
+		}
+		n = size
+	}
+	addr, err = o.Serialize(s)
+	return n, addr, byte('S'), err
+}
+
+func (o *Opi) addHole(s *SuperChunk, offset uint64, length uint64) error {
+	addr, err := o.Serialize(NewHole(length))
+	if err != nil {
+		return err
+	}
+	s.AddChild(offset, byte('z'), addr)
+	return nil
 }
 
 func (o *Opi) SliceUntil(stream *fwd.Reader, mask rollsum) (n uint64, addr []byte, metatype byte, r rollsum, err error) {
@@ -189,103 +356,623 @@ func (o *Opi) Chunk(stream *fwd.Reader) (n uint64, addr []byte, metatype byte, r
 	return uint64(n), addr, byte('C'), rollsum(roll.Sum64()), err
 }
 
-func (o *Opi) Snapshot(path string) (addr []byte, filetype byte, err error) {
+// Errors while reading the files are *os.PathError, which Archive can
+// skip. Any other error, e.g. from the storage, aborts.
+func (o *Opi) Snapshot(path string) (addr []byte, filetype byte, size uint64, err error) {
+	return (&archiver{Opi: o, root: path}).Snapshot(path)
+}
+
+func (a *archiver) Snapshot(path string) (addr []byte, filetype byte, size uint64, err error) {
 	info, err := os.Lstat(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, 0, err
 	}
 	switch {
 	case info.Mode()&os.ModeType == os.ModeDir:
 		files, err := ioutil.ReadDir(path)
 		if err != nil {
-			log.Fatal(err)
+			return nil, 0, 0, err
 		}
+		rel, _ := filepath.Rel(a.root, path)
+		if rel == "." {
+			rel = ""
+		}
+		// The patterns of the directory apply to its subtree only
+		defer func(n int) { a.patterns = a.patterns[:n] }(len(a.patterns))
+		if err = a.readIgnoreFile(path, rel); err != nil {
+			return nil, 0, 0, err
+		}
+		cache := a.options.ExcludeCaches && isCacheDir(path)
 		d := NewDir()
 		for _, f := range files {
-			info, err := os.Lstat(path + "/" + f.Name())
-			if err != nil {
-				log.Fatal(err)
+			if cache && f.Name() != cacheDirTag {
+				continue
+			}
+			if excluded(a.patterns, filepath.Join(rel, f.Name()), f.IsDir()) {
+				continue
 			}
-			addr, filetype, err := o.Snapshot(path + "/" + f.Name())
+			e, err := a.snapshotEntry(path + "/" + f.Name())
 			if err != nil {
-				log.Fatal(err)
+				if err = a.skip(path+"/"+f.Name(), err); err != nil {
+					return nil, 0, 0, err
+				}
+				continue
+			}
+			// Not recorded
+			if e.FileType == 0 {
+				continue
 			}
-			d.AddEntry(filetype, uint32(info.Mode()&os.ModePerm), []byte(f.Name()), []byte("xattr"), addr)
+			d.Add(*e)
 		}
-		addr, err := o.Serialize(d)
-		return addr, byte('d'), err
+		addr, err := a.Serialize(d)
+		return addr, byte('d'), 0, err
 	case info.Mode()&os.ModeType == os.ModeSymlink:
 		target, err := os.Readlink(path)
 		if err != nil {
-			log.Fatal(err)
+			return nil, 0, 0, err
 		}
 		s := NewSymlink(target)
-		addr, err := o.Serialize(s)
-		return addr, byte('l'), err
+		addr, err := a.Serialize(s)
+		return addr, byte('l'), uint64(len(target)), err
 	case info.Mode()&os.ModeType == 0:
-		return o.Slice(path)
-	default:
-		fmt.Printf("%s: file type not supported\n", path)
+		id, linked := inode(info)
+		if !linked || a.links == nil {
+			return a.Slice(path)
+		}
+		if f, ok := a.links[id]; ok {
+			addr, err := a.Serialize(f.link)
+			return addr, byte('h'), f.size, err
+		}
+		addr, filetype, size, err = a.Slice(path)
+		if err == nil {
+			target, _ := filepath.Rel(a.root, path)
+			a.links[id] = linkedFile{NewHardlink(target, filetype, addr), size}
+		}
+		return addr, filetype, size, err
+	case info.Mode()&os.ModeNamedPipe != 0:
+		addr, err := a.Serialize(NewDevice(0, 0))
+		return addr, byte('p'), 0, err
+	case info.Mode()&os.ModeDevice != 0:
+		filetype = byte('b')
+		if info.Mode()&os.ModeCharDevice != 0 {
+			filetype = byte('c')
+		}
+		addr, err := a.Serialize(NewDevice(deviceNumbers(info)))
+		return addr, filetype, 0, err
+	case info.Mode()&os.ModeSocket != 0:
+		// A socket is created by the process listening on it, a
+		// restored one would be useless. They are left out, and
+		// reported whatever the policy.
+		a.recordSkipped(path, &os.PathError{Op: "snapshot", Path: path, Err: errors.New("socket not archived")})
+		return nil, 0, 0, nil
 	}
-	return
+	return nil, 0, 0, &os.PathError{Op: "snapshot", Path: path, Err: errors.New("file type not supported")}
+}
+
+// Adds the patterns of the .opiignore file of dir, if any
+func (a *archiver) readIgnoreFile(dir string, rel string) error {
+	f, err := os.Open(dir + "/" + ignoreFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	patterns, err := readPatterns(f, rel)
+	if err != nil {
+		return &os.PathError{Op: "read", Path: f.Name(), Err: err}
+	}
+	a.patterns = append(a.patterns, patterns...)
+	return nil
+}
+
+func (a *archiver) snapshotEntry(path string) (*DirEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	addr, filetype, size, err := a.Snapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	atime, uid, gid := statExtra(info)
+	if !a.options.RecordAtime {
+		atime = time.Time{}
+	}
+	e := &DirEntry{
+		FileType: filetype,
+		Mode:     unixMode(info.Mode()),
+		Name:     []byte(info.Name()),
+		Addr:     addr,
+		Size:     size,
+		Mtime:    info.ModTime(),
+		Atime:    atime,
+		Uid:      uid,
+		Gid:      gid,
+	}
+	if filetype != 0 {
+		err = a.snapshotXattr(path, e)
+	}
+	return e, err
+}
+
+// Returns err unless the policy is to skip the files that cannot be read,
+// in which case path is recorded as skipped
+func (a *archiver) skip(path string, err error) error {
+	if _, ok := err.(*os.PathError); !ok || a.options.OnError != SkipOnError {
+		return err
+	}
+	a.recordSkipped(path, err)
+	return nil
+}
+
+func (a *archiver) recordSkipped(path string, err error) {
+	rel, _ := filepath.Rel(a.root, path)
+	a.skipped = append(a.skipped, SkippedFile{Path: rel, Reason: err.Error()})
+}
+
+// Records the ACLs of a file in e, and stores its other extended
+// attributes, if any.
+func (o *Opi) snapshotXattr(path string, e *DirEntry) (err error) {
+	x, err := listXattr(path)
+	if err != nil {
+		return err
+	}
+	if value, ok := x.Attributes[aclAccessXattr]; ok {
+		if e.ACL, err = ParseACLXattr(value); err != nil {
+			return &os.PathError{Op: "getfacl", Path: path, Err: err}
+		}
+		delete(x.Attributes, aclAccessXattr)
+	}
+	if value, ok := x.Attributes[aclDefaultXattr]; ok {
+		if e.DefaultACL, err = ParseACLXattr(value); err != nil {
+			return &os.PathError{Op: "getfacl", Path: path, Err: err}
+		}
+		delete(x.Attributes, aclDefaultXattr)
+	}
+	if len(x.Attributes) > 0 {
+		e.Xattr, err = o.Serialize(x)
+	}
+	return err
 }
 
 func (o *Opi) Archive(path string, name string) error {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Fatal(err)
+	_, err := o.ArchiveWith(path, name, ArchiveOptions{})
+	return err
+}
+
+// ArchiveWith archives path under name, and returns the files skipped
+// according to opts, and the sockets.
+func (o *Opi) ArchiveWith(path string, name string, opts ArchiveOptions) (skipped []SkippedFile, err error) {
+	if err = checkName([]byte(name)); err != nil {
+		return nil, err
+	}
+	a := &archiver{Opi: o.fork(), root: path, links: make(map[fileId]linkedFile), options: opts}
+	if a.patterns, err = excludePatterns(opts); err != nil {
+		return nil, err
+	}
+	err = a.archive(path, name)
+	return a.skipped, err
+}
+
+func excludePatterns(opts ArchiveOptions) ([]ignorePattern, error) {
+	patterns, err := readPatterns(strings.NewReader(strings.Join(opts.Exclude, "\n")), "")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range opts.ExcludeFiles {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
 		}
-	}()
-	addr, filetype, err := o.Snapshot(path)
+		p, err := readPatterns(f, "")
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		patterns = append(patterns, p...)
+	}
+	return patterns, nil
+}
+
+func (a *archiver) archive(path string, name string) error {
+	addr, filetype, _, err := a.Snapshot(path)
+	// Wait for the pending writes even on error, so that no goroutine
+	// outlives the call
+	if errFlush := a.Flush(); err == nil {
+		err = errFlush
+	}
+	if err != nil {
+		return err
+	}
 	if filetype != byte('d') {
 		return errors.New("Can only archive a directory")
 	}
+	hostname, err := os.Hostname()
 	if err != nil {
 		return err
 	}
-	hostname, err := os.Hostname()
+	// The previous snapshot under the same name becomes the parent
+	var parents [][]byte
+	switch parent, err := a.Resolve(name); err {
+	case nil:
+		parents = append(parents, parent)
+	case ErrNotFound:
+	default:
+		return err
+	}
+	c := NewCommit(time.Now(), addr, []byte(hostname), []byte(hostname), parents)
+	if a.options.RecordSkipped {
+		c.Skipped = a.skipped
+	}
+	addr, err = a.Serialize(c)
+	if err != nil {
+		return err
+	}
+	// The tree and the commit must be stored before the name points to them
+	if err = a.Flush(); err != nil {
+		return err
+	}
+	encodedAddr, err := a.Encode(addr)
+	if err != nil {
+		return err
+	}
+	return a.SetRef([]byte(name), encodedAddr)
+}
+
+// Resolve returns the address of the commit a snapshot name points to.
+// Repositories created before names had their own namespace stored them
+// among the objects, they are still looked up there.
+func (o *Opi) Resolve(name string) (addr []byte, err error) {
+	if err = checkName([]byte(name)); err != nil {
+		return nil, err
+	}
+	encodedAddr, err := o.GetRef([]byte(name))
+	if err == ErrNotFound && o.hash.keyAddr([]byte(name)) == nil && !isRepoKey([]byte(name)) {
+		encodedAddr, err = o.Get([]byte(name))
+		if err == nil && len(encodedAddr) == 0 {
+			err = ErrNotFound
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o.Decode(encodedAddr)
+}
+
+// ReadCommitAt fetches and decodes the commit stored at addr
+func (o *Opi) ReadCommitAt(addr []byte) (*Commit, error) {
+	b, err := o.DeSerialize(addr)
+	if err != nil {
+		return nil, err
+	}
+	return ReadCommit(b)
+}
+
+// Snapshots calls fn on every snapshot name, in lexical order, along with
+// the address of its commit and the commit itself.
+func (o *Opi) Snapshots(fn func(name string, addr []byte, c *Commit) error) error {
+	var names []string
+	err := o.Refs(nil, func(name []byte) error {
+		names = append(names, string(name))
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	c := NewCommit(time.Now(), addr, []byte(hostname), []byte(hostname), nil)
-	addr, err = o.Serialize(c)
+	for _, name := range names {
+		addr, err := o.Resolve(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		c, err := o.ReadCommitAt(addr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err = fn(name, addr, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History calls fn on the commit a snapshot name points to, then on its
+// first parent, and so on until the first snapshot taken under that name.
+func (o *Opi) History(name string, fn func(addr []byte, c *Commit) error) error {
+	addr, err := o.Resolve(name)
 	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for addr != nil {
+		c, err := o.ReadCommitAt(addr)
+		if err != nil {
+			return err
+		}
+		if err = fn(addr, c); err != nil {
+			return err
+		}
+		addr = nil
+		if len(c.Parents) > 0 {
+			addr = c.Parents[0]
+		}
+	}
+	return nil
+}
+
+// Remove forgets the snapshot name and its history. Their objects are
+// collected by the next GC, unless other snapshots share them.
+func (o *Opi) Remove(name string) error {
+	if err := checkName([]byte(name)); err != nil {
+		return err
+	}
+	switch _, err := o.GetRef([]byte(name)); err {
+	case nil:
+		return o.DelRef([]byte(name))
+	case ErrNotFound:
+	default:
+		return err
+	}
+	// Stored among the objects by older versions
+	if _, err := o.Resolve(name); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return o.Del([]byte(name))
+}
+
+var errEnoughHistory = errors.New("Enough history")
+
+// Prune keeps the keep most recent snapshots taken under name, and forgets
+// the older ones, so that GC can collect them. The kept commits are
+// written again with their new parents, their addresses change.
+func (o *Opi) Prune(name string, keep int) error {
+	if keep < 1 {
+		return errors.New("At least one snapshot must be kept")
+	}
+	var commits []*Commit
+	err := o.History(name, func(addr []byte, c *Commit) error {
+		commits = append(commits, c)
+		if len(commits) == keep {
+			return errEnoughHistory
+		}
+		return nil
+	})
+	if err != nil && err != errEnoughHistory {
+		return err
+	}
+	oldest := commits[len(commits)-1]
+	if len(oldest.Parents) == 0 {
+		return nil
+	}
+	var addr []byte
+	for i := len(commits) - 1; i >= 0; i-- {
+		c := commits[i]
+		if addr == nil {
+			c.Parents = nil
+		} else {
+			c.Parents[0] = addr
+		}
+		if addr, err = o.Serialize(c); err != nil {
+			return err
+		}
+	}
+	if err = o.Flush(); err != nil {
 		return err
 	}
 	encodedAddr, err := o.Encode(addr)
 	if err != nil {
 		return err
 	}
-	o.Set([]byte(name), encodedAddr)
+	if err = o.SetRef([]byte(name), encodedAddr); err != nil {
+		return err
+	}
+	// A name stored among the objects by older versions would keep the
+	// old history reachable
+	if o.hash.keyAddr([]byte(name)) == nil && !isRepoKey([]byte(name)) {
+		switch err = o.Hit([]byte(name)); err {
+		case nil:
+			return o.Del([]byte(name))
+		case ErrNotFound:
+			return nil
+		}
+	}
+	return err
+}
+
+// TreeOf returns the address of the root directory of a snapshot
+func (o *Opi) TreeOf(name string) ([]byte, error) {
+	addr, err := o.Resolve(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	c, err := o.ReadCommitAt(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.Tree, nil
+}
+
+// Lookup walks the directories from tree to find the entry at path. The
+// empty path designates tree itself.
+func (o *Opi) Lookup(tree []byte, path string) (*DirEntry, error) {
+	e := &DirEntry{FileType: byte('d'), Mode: 0777, Addr: tree, Size: 0}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if e.FileType != byte('d') {
+			return nil, fmt.Errorf("%s: not a directory", e.Name)
+		}
+		b, err := o.DeSerialize(e.Addr)
+		if err != nil {
+			return nil, err
+		}
+		d, err := ReadDir(b)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for i := range d.Entries {
+			if string(d.Entries[i].Name) == name {
+				e, found = &d.Entries[i], true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: no such file or directory", path)
+		}
+	}
+	return e, nil
+}
+
+// Size returns the length of the content of an entry: the number of
+// bytes of a regular file, the length of the target of a symlink. It is 0
+// for directories. Entries read from old directory objects do not record
+// it, it is then computed from their content.
+func (o *Opi) Size(e *DirEntry) (uint64, error) {
+	if e.Size != UnknownSize {
+		return e.Size, nil
+	}
+	switch e.FileType {
+	case byte('C'), byte('l'):
+		b, err := o.DeSerialize(e.Addr)
+		return uint64(len(b)), err
+	case byte('z'):
+		b, err := o.DeSerialize(e.Addr)
+		if err != nil {
+			return 0, err
+		}
+		h, err := ReadHole(b)
+		if err != nil {
+			return 0, err
+		}
+		return h.Length, nil
+	case byte('S'):
+		b, err := o.DeSerialize(e.Addr)
+		if err != nil {
+			return 0, err
+		}
+		s, err := ReadSuperChunk(b)
+		if err != nil {
+			return 0, err
+		}
+		if len(s.Children) == 0 {
+			return 0, nil
+		}
+		// The last child ends the file
+		last := s.Children[len(s.Children)-1]
+		n, err := o.Size(&DirEntry{FileType: last.MetaType, Addr: last.Addr, Size: UnknownSize})
+		return last.Offset + n, err
+	}
+	return 0, nil
+}
+
+// Walk calls fn on every entry of the directory at addr, designating each
+// of them by its path relative to the directory, prefixed with prefix.
+// With recursive, the subdirectories are walked too, after fn is called
+// on them.
+func (o *Opi) Walk(addr []byte, prefix string, recursive bool, fn func(path string, e *DirEntry) error) error {
+	b, err := o.DeSerialize(addr)
 	if err != nil {
 		return err
 	}
+	d, err := ReadDir(b)
+	if err != nil {
+		return err
+	}
+	for i := range d.Entries {
+		e := &d.Entries[i]
+		path := prefix + string(e.Name)
+		if err = fn(path, e); err != nil {
+			return err
+		}
+		if recursive && e.FileType == byte('d') {
+			if err = o.Walk(e.Addr, path+"/", recursive, fn); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func (o *Opi) Restore(name string, path string) error {
-	// address of the top commit
-	encodedAddr, err := o.Get([]byte(name))
+// Ls calls fn on the entries of the directory found at inner in the
+// snapshot, or on the entry itself if it is not a directory.
+func (o *Opi) Ls(name string, inner string, recursive bool, fn func(path string, e *DirEntry) error) error {
+	tree, err := o.TreeOf(name)
 	if err != nil {
 		return err
 	}
-	addr, err := o.Decode(encodedAddr)
+	e, err := o.Lookup(tree, inner)
 	if err != nil {
 		return err
 	}
-	// top commit
-	b, err := o.DeSerialize(addr)
+	if e.FileType != byte('d') {
+		return fn(inner, e)
+	}
+	prefix := strings.Trim(inner, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return o.Walk(e.Addr, prefix, recursive, fn)
+}
+
+func (o *Opi) Restore(name string, path string) error {
+	return o.RestorePath(name, "", path)
+}
+
+// RestorePath restores the file or directory found at inner in the
+// snapshot. The content of a directory is rebuilt in dest, which must
+// exist. Any other file is restored at dest, or inside dest if dest is an
+// existing directory.
+func (o *Opi) RestorePath(name string, inner string, dest string) error {
+	return o.RestoreWith(name, inner, dest, RestoreOptions{})
+}
+
+// RestoreWith is RestorePath, handling the files already present at the
+// destination according to opts.
+func (o *Opi) RestoreWith(name string, inner string, dest string, opts RestoreOptions) error {
+	if opts.Delete && opts.Mode == FailIfExists {
+		return errors.New("Delete requires Overwrite or Sync")
+	}
+	tree, err := o.TreeOf(name)
 	if err != nil {
 		return err
 	}
-	c, err := ReadCommit(b)
+	e, err := o.Lookup(tree, inner)
 	if err != nil {
 		return err
 	}
-	return o.Rebuild(c.Tree, path)
+	if e.FileType != byte('d') {
+		if info, err := os.Stat(dest); err == nil && info.IsDir() {
+			dest = filepath.Join(dest, string(e.Name))
+		}
+	}
+	r := &restorer{Opi: o, from: strings.Trim(filepath.Clean("/"+inner), "/"), to: dest, options: opts}
+	if e.FileType == byte('d') {
+		return r.Rebuild(e.Addr, dest)
+	}
+	return r.RebuildEntry(e, dest)
+}
+
+// Returns where the file found at target in the snapshot is restored, if
+// it is part of the current restore.
+func (r *restorer) restoredPath(target string) (string, bool) {
+	switch {
+	case r.to == "":
+		return "", false
+	case r.from == "":
+		return filepath.Join(r.to, target), true
+	case strings.HasPrefix(target, r.from+"/"):
+		return filepath.Join(r.to, target[len(r.from)+1:]), true
+	}
+	return "", false
 }
 
 func (o *Opi) Rebuild(addr []byte, dest string) (err error) {
+	return (&restorer{Opi: o}).Rebuild(addr, dest)
+}
+
+func (r *restorer) Rebuild(addr []byte, dest string) (err error) {
 	// dest must exist
 	info, err := os.Lstat(dest)
 	if err != nil {
@@ -294,7 +981,7 @@ func (o *Opi) Rebuild(addr []byte, dest string) (err error) {
 	if !info.IsDir() {
 		return errors.New("Destination is not a directory")
 	}
-	b, err := o.DeSerialize(addr)
+	b, err := r.DeSerialize(addr)
 	if err != nil {
 		return err
 	}
@@ -302,54 +989,401 @@ func (o *Opi) Rebuild(addr []byte, dest string) (err error) {
 	if err != nil {
 		return err
 	}
+	for i := range d.Entries {
+		name := dest + "/" + string(d.Entries[i].Name)
+		if err = r.RebuildEntry(&d.Entries[i], name); err != nil {
+			return err
+		}
+	}
+	if r.options.Delete {
+		return deleteExtra(d, dest)
+	}
+	return nil
+}
+
+// Deletes the files of dest that are not entries of d
+func deleteExtra(d *Dir, dest string) error {
+	files, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
 	for _, e := range d.Entries {
-		name := dest + "/" + string(e.Name)
-		_, err := os.Lstat(name)
-		if err == nil {
+		names[string(e.Name)] = true
+	}
+	for _, f := range files {
+		if names[f.Name()] {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(dest, f.Name())); err != nil {
+			return err
+		}
+		fmt.Printf("%s deleted\n", filepath.Join(dest, f.Name()))
+	}
+	return nil
+}
+
+// RebuildEntry restores a single directory entry at the path name
+func (o *Opi) RebuildEntry(e *DirEntry, name string) (err error) {
+	return (&restorer{Opi: o}).RebuildEntry(e, name)
+}
+
+func (r *restorer) RebuildEntry(e *DirEntry, name string) (err error) {
+	existing, err := os.Lstat(name)
+	if err == nil {
+		if r.options.Mode == FailIfExists {
 			return errors.New("Destination already exists")
 		}
-		switch {
-		case e.FileType == byte('d'):
-			os.Mkdir(name, 0777)
-			o.Rebuild(e.Addr, name)
-		case e.FileType == byte('l'):
-			b, err := o.DeSerialize(e.Addr)
-			if err != nil {
+		// Directories and regular files are updated, anything else is
+		// replaced
+		if !(e.FileType == byte('d') && existing.IsDir()) && !(isRegular(e.FileType) && existing.Mode().IsRegular()) {
+			if err = os.RemoveAll(name); err != nil {
 				return err
 			}
-			s, err := ReadSymlink(b)
-			if err != nil {
+			existing = nil
+		}
+	} else {
+		existing = nil
+	}
+	switch {
+	case e.FileType == byte('d'):
+		if existing == nil {
+			if err = os.Mkdir(name, 0777); err != nil {
 				return err
 			}
-			os.Symlink(s.Target, name)
-		case e.FileType == byte('S') || e.FileType == byte('C'):
-			var f *os.File
-			if f, err = os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666); err != nil {
+		}
+		if err = r.Rebuild(e.Addr, name); err != nil {
+			return err
+		}
+	case e.FileType == byte('l'):
+		b, err := r.DeSerialize(e.Addr)
+		if err != nil {
+			return err
+		}
+		s, err := ReadSymlink(b)
+		if err != nil {
+			return err
+		}
+		if err = os.Symlink(s.Target, name); err != nil {
+			return err
+		}
+	case e.FileType == byte('S') || e.FileType == byte('C'):
+		if existing != nil {
+			err = r.updateFile(e, name, existing)
+		} else {
+			err = r.rebuildFile(e, name)
+		}
+		if err != nil {
+			return err
+		}
+	case e.FileType == byte('h'):
+		if err = r.rebuildHardlink(e, name, existing); err != nil {
+			return err
+		}
+	case e.FileType == byte('c') || e.FileType == byte('b') || e.FileType == byte('p'):
+		b, err := r.DeSerialize(e.Addr)
+		if err != nil {
+			return err
+		}
+		d, err := ReadDevice(b)
+		if err != nil {
+			return err
+		}
+		err = mknod(name, e.FileType, d.Major, d.Minor)
+		// Creating devices requires privileges
+		if os.IsPermission(err) {
+			fmt.Printf("%s: %v, skipped\n", name, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// A directory gets its metadata after its children are written, so
+	// that they do not alter its timestamps
+	if err = r.restoreMetadata(e, name); err != nil {
+		return err
+	}
+	fmt.Println(name)
+	return nil
+}
+
+// Applies the ownership, the extended attributes, the ACLs, the
+// permissions and the timestamps of e to the file name. Like tar, it keeps
+// the current owner and skips the attributes it is not permitted to set.
+func (o *Opi) restoreMetadata(e *DirEntry, name string) error {
+	// Older directory objects only recorded the permissions
+	recorded := !e.Mtime.IsZero()
+	if recorded {
+		err := os.Lchown(name, int(e.Uid), int(e.Gid))
+		if err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+	// After chown, which clears security.capability
+	if o.hash.isAddr(e.Xattr) {
+		b, err := o.DeSerialize(e.Xattr)
+		if err != nil {
+			return err
+		}
+		x, err := ReadXattr(b)
+		if err != nil {
+			return err
+		}
+		for attr, value := range x.Attributes {
+			if err := restoreXattr(name, attr, value); err != nil {
 				return err
 			}
-			defer func() {
-				if closingErr := f.Close(); err == nil {
-					err = closingErr
-				}
-			}()
-			stream := bufio.NewWriter(f)
-			if e.FileType == byte('S') {
-				if err = o.Glue(e.Addr, stream); err != nil {
-					return err
-				}
-			} else {
-				if err = o.WriteChunk(e.Addr, stream); err != nil {
-					return err
-				}
+		}
+	}
+	acls := map[string]ACL{aclAccessXattr: e.ACL, aclDefaultXattr: e.DefaultACL}
+	for attr, acl := range acls {
+		if len(acl) == 0 {
+			continue
+		}
+		if err := restoreXattr(name, attr, acl.XattrValue()); err != nil {
+			return err
+		}
+	}
+	// chmod would apply to the target of a symlink
+	if e.FileType != byte('l') {
+		if err := os.Chmod(name, fileMode(e.Mode)); err != nil {
+			return err
+		}
+	}
+	if recorded {
+		return lutimes(name, e.Atime, e.Mtime)
+	}
+	return nil
+}
+
+// Sets an extended attribute. Those the user may not set, or that the
+// filesystem does not support, are skipped.
+func restoreXattr(name string, attr string, value []byte) error {
+	err := setXattr(name, attr, value)
+	if os.IsPermission(err) || isNotSupported(err) {
+		fmt.Printf("%s: %s: %v, skipped\n", name, attr, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s: %v", name, attr, err)
+	}
+	return nil
+}
+
+// The permissions are stored with the setuid, setgid and sticky bits, as in
+// st_mode
+const (
+	modeSetuid = 04000
+	modeSetgid = 02000
+	modeSticky = 01000
+)
+
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m & os.ModePerm)
+	if m&os.ModeSetuid != 0 {
+		mode |= modeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= modeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= modeSticky
+	}
+	return mode
+}
+
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&modeSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&modeSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&modeSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// Regular files are stored as a superchunk, a chunk, or a hardlink to
+// another one
+func isRegular(fileType byte) bool {
+	return fileType == byte('S') || fileType == byte('C') || fileType == byte('h')
+}
+
+// Rewrites the existing file name with the content of e. With Sync, it is
+// left untouched if it has the same content.
+func (r *restorer) updateFile(e *DirEntry, name string, existing os.FileInfo) error {
+	if r.options.Mode == Sync {
+		same, err := r.sameContent(e, name, existing)
+		if same || err != nil {
+			return err
+		}
+	}
+	// Written aside and renamed, so that name is never seen partially
+	// written
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	if err = r.rebuildFile(e, tmp); err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Like rsync, files of the same size and modification time are assumed to
+// be the same. Otherwise, the contents are compared.
+func (o *Opi) sameContent(e *DirEntry, name string, existing os.FileInfo) (same bool, err error) {
+	size, err := o.Size(e)
+	if err != nil || size != uint64(existing.Size()) {
+		return false, err
+	}
+	if !e.Mtime.IsZero() && e.Mtime.Equal(existing.ModTime()) {
+		return true, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	err = o.WriteContent(e, &compareWriter{bufio.NewReader(f)})
+	if err == errDiffers {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+var errDiffers = errors.New("Content differs")
+
+// Compares what is written with what is read
+type compareWriter struct {
+	r io.Reader
+}
+
+func (w *compareWriter) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	if _, err := io.ReadFull(w.r, b); err != nil {
+		return 0, errDiffers
+	}
+	if !bytes.Equal(b, p) {
+		return 0, errDiffers
+	}
+	return len(p), nil
+}
+
+func (o *Opi) rebuildFile(e *DirEntry, name string) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0666); err != nil {
+		return err
+	}
+	defer func() {
+		if closingErr := f.Close(); err == nil {
+			err = closingErr
+		}
+	}()
+	stream := &sparseWriter{bufio.NewWriter(f), f}
+	if err = o.WriteContent(e, stream); err != nil {
+		return err
+	}
+	if err = stream.Flush(); err != nil {
+		return err
+	}
+	// A trailing hole is not written
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(end)
+}
+
+// A stream to a file, where holes are skipped rather than written
+type sparseWriter struct {
+	*bufio.Writer
+	f *os.File
+}
+
+func (w *sparseWriter) Skip(n uint64) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := w.f.Seek(int64(n), io.SeekCurrent)
+	return err
+}
+
+// The target of a hardlink is restored before it, in the same traversal
+// order as the snapshot. When it is not part of the restore, the content is
+// written again.
+func (r *restorer) rebuildHardlink(e *DirEntry, name string, existing os.FileInfo) error {
+	b, err := r.DeSerialize(e.Addr)
+	if err != nil {
+		return err
+	}
+	h, err := ReadHardlink(b)
+	if err != nil {
+		return err
+	}
+	if source, ok := r.restoredPath(h.Target); ok {
+		if existing != nil {
+			if info, err := os.Lstat(source); err == nil && os.SameFile(info, existing) {
+				return nil
 			}
-			if err = stream.Flush(); err != nil {
+			if err = os.Remove(name); err != nil {
 				return err
 			}
+			existing = nil
+		}
+		if err = os.Link(source, name); err == nil {
+			return nil
 		}
-		os.Chmod(name, os.FileMode(e.Mode))
-		fmt.Println(name)
 	}
-	return nil
+	content := &DirEntry{FileType: h.MetaType, Addr: h.Addr, Size: e.Size, Mtime: e.Mtime}
+	if existing != nil {
+		return r.updateFile(content, name, existing)
+	}
+	return r.rebuildFile(content, name)
+}
+
+// WriteContent writes the content of the regular file e to stream
+func (o *Opi) WriteContent(e *DirEntry, stream io.Writer) error {
+	switch e.FileType {
+	case byte('S'):
+		return o.Glue(e.Addr, stream)
+	case byte('C'):
+		return o.WriteChunk(e.Addr, stream)
+	case byte('h'):
+		b, err := o.DeSerialize(e.Addr)
+		if err != nil {
+			return err
+		}
+		h, err := ReadHardlink(b)
+		if err != nil {
+			return err
+		}
+		return o.WriteContent(&DirEntry{Name: e.Name, FileType: h.MetaType, Addr: h.Addr}, stream)
+	}
+	return fmt.Errorf("%s: not a regular file", e.Name)
+}
+
+// Cat writes the content of the file found at inner in the snapshot to
+// stream, without touching the disk.
+func (o *Opi) Cat(name string, inner string, stream io.Writer) error {
+	tree, err := o.TreeOf(name)
+	if err != nil {
+		return err
+	}
+	e, err := o.Lookup(tree, inner)
+	if err != nil {
+		return err
+	}
+	return o.WriteContent(e, stream)
 }
 
 func (o *Opi) WriteChunk(addr []byte, stream io.Writer) (err error) {
@@ -386,7 +1420,40 @@ func (o *Opi) Glue(addr []byte, stream io.Writer) (err error) {
 			if err != nil {
 				return err
 			}
+		case c.MetaType == byte('z'):
+			err := o.WriteHole(c.Addr, stream)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteHole seeks over the hole when stream is a file, and writes zeros
+// otherwise
+func (o *Opi) WriteHole(addr []byte, stream io.Writer) error {
+	b, err := o.DeSerialize(addr)
+	if err != nil {
+		return err
+	}
+	h, err := ReadHole(b)
+	if err != nil {
+		return err
+	}
+	if w, ok := stream.(interface{ Skip(n uint64) error }); ok {
+		return w.Skip(h.Length)
+	}
+	zeros := make([]byte, 32*1024)
+	for n := h.Length; n > 0; {
+		m := uint64(len(zeros))
+		if n < m {
+			m = n
+		}
+		if _, err := stream.Write(zeros[:m]); err != nil {
+			return err
 		}
+		n -= m
 	}
 	return nil
 }
@@ -1,39 +1,88 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"code.cloudfoundry.org/bytefmt"
 	"github.com/chmduquesne/opi"
 )
 
 const (
 	usage = `Usage:
-	archive <path> <id>
-	restore <id> <path>
+	archive [-skip-errors] [-record-skipped] [-exclude <pattern>]... [-exclude-file <file>]... [-exclude-caches] [-atime] <path> <id>
+	restore [-overwrite|-sync] [-delete] <id>[:<path in snapshot>] <path>
+	gc [-n]
+	rm <id>
+	prune <id> <number of snapshots kept>
+	list [-json]
+	log <id>
+	cat <id>:<path in snapshot>
+	ls [-R] [-acl] <id>[:<path in snapshot>]
+	init-key [-keyed]
+
+Every snapshot taken under a name stays reachable through the next one. gc
+only reclaims their space once they are forgotten, with rm for the whole
+history of a name, or with prune for its oldest snapshots.
+
+Objects are compressed according to $OPI_COMPRESSION: snappy (default),
+zstd[:<level>], lz4 or none. $OPI_ZSTD_DICT is the path of a dictionary for
+zstd, stored in the repository by archive so that the objects compressed
+with it can be read without it. Objects that compression does not shrink by
+$OPI_MIN_SAVING percent, from 0 to 100, are stored uncompressed.
+
+The addresses of the objects of a new repository are computed with
+$OPI_HASH: blake3 (default), sha256 or sha512-256. The hash is recorded in
+the repository by its first archive or init-key.
+
+The objects are encrypted with the passphrase in $OPI_PASSPHRASE, if set.
+init-key creates the key file of a new encrypted repository. With -keyed,
+the addresses of the objects are keyed too, so that the storage cannot tell
+whether a known file was archived. The objects of a repository encrypted
+after it was used are only read with OPI_MIGRATE=1 set, as those stored in
+clear cannot be authenticated.
 	`
 )
 
 func OpiServed() func() {
-	fmt.Println("Starting opi-serve")
+	// stdout is reserved for the output of the commands
+	fmt.Fprintln(os.Stderr, "Starting opi-serve")
 	cmd := exec.Command("opi-serve")
 	err := cmd.Start()
 	stop := func() {
-		fmt.Println("Stopping opi-serve")
+		fmt.Fprintln(os.Stderr, "Stopping opi-serve")
 		if err != nil {
-			fmt.Errorf("%v", err)
+			fmt.Fprintln(os.Stderr, err)
 		} else {
 			err = cmd.Process.Signal(os.Kill)
 			if err != nil {
-				fmt.Errorf("%v", err)
+				fmt.Fprintln(os.Stderr, err)
 			}
 		}
 	}
+	// Wait for opi-serve to accept connections
+	for i := 0; err == nil && i < 50; i++ {
+		conn, errDial := net.Dial("tcp", opi.Host())
+		if errDial == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
@@ -44,11 +93,239 @@ func OpiServed() func() {
 	return stop
 }
 
+// Minimum and maximum number of arguments of each command, -1 if there is
+// no maximum
+var arity = map[string][2]int{
+	"archive":  {2, -1},
+	"restore":  {2, 4},
+	"gc":       {0, 1},
+	"rm":       {1, 1},
+	"prune":    {2, 2},
+	"list":     {0, 1},
+	"log":      {1, 1},
+	"cat":      {1, 1},
+	"ls":       {1, 3},
+	"init-key": {0, 1},
+}
+
+// Description of a snapshot, as printed by list -json
+type snapshotInfo struct {
+	Name    string    `json:"name"`
+	Commit  string    `json:"commit"`
+	Date    time.Time `json:"date"`
+	Host    string    `json:"host"`
+	Replica string    `json:"replica"`
+	Tree    string    `json:"tree"`
+	Parents int       `json:"parents"`
+	Skipped int       `json:"skipped"`
+}
+
+func List(o opi.Timeline, h *opi.Hash, asJSON bool) error {
+	infos := []snapshotInfo{}
+	err := o.Snapshots(func(name string, addr []byte, c *opi.Commit) error {
+		infos = append(infos, snapshotInfo{
+			Name:    name,
+			Commit:  h.Hex(addr),
+			Date:    c.Date,
+			Host:    string(c.Host),
+			Replica: string(c.Replica),
+			Tree:    h.Hex(c.Tree),
+			Parents: len(c.Parents),
+			Skipped: len(c.Skipped),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDATE\tHOST\tREPLICA\tPARENTS\tTREE")
+	for _, i := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			i.Name, i.Date.Format(time.RFC3339), i.Host, i.Replica, i.Parents, i.Tree)
+	}
+	return w.Flush()
+}
+
+func Log(o opi.Timeline, h *opi.Hash, name string) error {
+	return o.History(name, func(addr []byte, c *opi.Commit) error {
+		fmt.Printf("commit %s\n", h.Hex(addr))
+		fmt.Printf("Date:    %s\n", c.Date.Format(time.RFC3339))
+		fmt.Printf("Host:    %s\n", c.Host)
+		fmt.Printf("Replica: %s\n", c.Replica)
+		fmt.Printf("Tree:    %s\n", h.Hex(c.Tree))
+		for _, s := range c.Skipped {
+			fmt.Printf("Skipped: %s (%s)\n", s.Path, s.Reason)
+		}
+		fmt.Println()
+		return nil
+	})
+}
+
+// Type of an entry, as the first letter of ls -l
+func typeLetter(fileType byte) string {
+	switch fileType {
+	case byte('d'):
+		return "d"
+	case byte('l'):
+		return "l"
+	case byte('c'):
+		return "c"
+	case byte('b'):
+		return "b"
+	case byte('p'):
+		return "p"
+	}
+	return "-"
+}
+
+// Permissions of an entry, as printed by ls -l: setuid and setgid replace
+// the x of their class with s, or S if it is not executable, and the sticky
+// bit that of the others with t or T
+func permString(mode uint32) string {
+	perm := []byte(os.FileMode(mode).Perm().String()[1:])
+	special := []struct {
+		bit    uint32
+		i      int
+		letter byte
+	}{{04000, 2, 's'}, {02000, 5, 's'}, {01000, 8, 't'}}
+	for _, s := range special {
+		if mode&s.bit == 0 {
+			continue
+		}
+		if perm[s.i] == 'x' {
+			perm[s.i] = s.letter
+		} else {
+			perm[s.i] = s.letter - 'a' + 'A'
+		}
+	}
+	return string(perm)
+}
+
+// With showACL, the ACLs of the entries are printed below them. Entries
+// having ACLs are marked with a '+' anyway, like ls does.
+func Ls(o opi.Timeline, h *opi.Hash, arg string, recursive bool, showACL bool) error {
+	name, inner := SplitName(arg)
+	w := bufio.NewWriter(os.Stdout)
+	err := o.Ls(name, inner, recursive, func(path string, e *opi.DirEntry) error {
+		size, err := o.Size(e)
+		if err != nil {
+			return err
+		}
+		perm := permString(e.Mode)
+		if len(e.ACL) > 0 || len(e.DefaultACL) > 0 {
+			perm += "+"
+		} else {
+			perm += " "
+		}
+		fmt.Fprintf(w, "%s%s %12d %s %s\n", typeLetter(e.FileType), perm, size, h.Hex(e.Addr), path)
+		if showACL && len(e.ACL) > 0 {
+			fmt.Fprintf(w, "    access: %s\n", e.ACL)
+		}
+		if showACL && len(e.DefaultACL) > 0 {
+			fmt.Fprintf(w, "    default: %s\n", e.DefaultACL)
+		}
+		return nil
+	})
+	if errFlush := w.Flush(); err == nil {
+		err = errFlush
+	}
+	return err
+}
+
+// FramedCodec returns the codec configured by the environment, and the
+// level of its zstd compression
+func FramedCodec() (*opi.FramedCodec, int, error) {
+	spec := os.Getenv("OPI_COMPRESSION")
+	name, level := spec, opi.DefaultZstdLevel
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name = spec[:i]
+		if name != "zstd" {
+			return nil, 0, fmt.Errorf("OPI_COMPRESSION: %q takes no level", name)
+		}
+		n, err := strconv.Atoi(spec[i+1:])
+		if err != nil || n < 1 || n > 22 {
+			return nil, 0, fmt.Errorf("OPI_COMPRESSION: invalid level %q", spec[i+1:])
+		}
+		level = n
+	}
+	compressions := map[string]byte{
+		"":       opi.CompressionSnappy,
+		"snappy": opi.CompressionSnappy,
+		"none":   opi.CompressionNone,
+		"zstd":   opi.CompressionZstd,
+		"lz4":    opi.CompressionLZ4,
+	}
+	compression, ok := compressions[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("OPI_COMPRESSION: unknown compression %q", name)
+	}
+	c, err := opi.NewFramedCodec(compression)
+	if err != nil {
+		return nil, 0, err
+	}
+	if percent := os.Getenv("OPI_MIN_SAVING"); percent != "" {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, 0, fmt.Errorf("OPI_MIN_SAVING: invalid percentage %q", percent)
+		}
+		c.MinSaving = p / 100
+	}
+	c.Migrating = os.Getenv("OPI_MIGRATE") == "1"
+	return c, level, nil
+}
+
+// ZstdDict returns the dictionary set by the environment, or nil
+func ZstdDict() ([]byte, error) {
+	path := os.Getenv("OPI_ZSTD_DICT")
+	if path == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// Config returns the configuration of a new repository, as set by the
+// environment
+func Config() (*opi.Config, error) {
+	name := os.Getenv("OPI_HASH")
+	if name == "" {
+		return &opi.Config{Hash: opi.DefaultHash}, nil
+	}
+	h, err := opi.HashNamed(name)
+	if err != nil || h == opi.HashLegacy {
+		return nil, fmt.Errorf("OPI_HASH: unknown hash %q", name)
+	}
+	return &opi.Config{Hash: h}, nil
+}
+
+// Splits an argument of the form name:path/in/snapshot
+func SplitName(arg string) (name string, inner string) {
+	if i := strings.Index(arg, ":"); i >= 0 {
+		return arg[:i], arg[i+1:]
+	}
+	return arg, ""
+}
+
 func main() {
-	if len(os.Args) != 4 {
-		fmt.Print(usage)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
 		os.Exit(1)
 	}
+	n, ok := arity[os.Args[1]]
+	if a := len(os.Args) - 2; !ok || a < n[0] || (n[1] >= 0 && a > n[1]) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	a := os.Args[2:]
+
+	// Exit last, once the other deferred calls are done
+	status := 0
+	defer func() { os.Exit(status) }()
 
 	defer OpiServed()()
 
@@ -62,28 +339,226 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if os.Args[1] == "archive" {
-		s := opi.NewClient()
-		//s := opi.NewDB()
-		defer s.Close()
-		c := opi.NewSimpleCodec()
-		o := opi.NewOpi(s, c)
-		err := o.Archive(os.Args[2], os.Args[3])
-		if err != nil {
-			fmt.Println(err)
+	s := opi.NewClient()
+	//s := opi.NewDB()
+	defer s.Close()
+	framed, level, err := FramedCodec()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+		return
+	}
+	passphrase := os.Getenv("OPI_PASSPHRASE")
+	if os.Args[1] == "init-key" && passphrase == "" {
+		fmt.Fprintln(os.Stderr, "OPI_PASSPHRASE is not set")
+		status = 1
+		return
+	}
+	fresh, err := Config()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+		return
+	}
+	// Only the commands writing to the repository record its
+	// configuration
+	if os.Args[1] != "archive" && os.Args[1] != "init-key" {
+		fresh = nil
+	}
+	cfg, err := opi.OpenConfig(s, fresh)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+		return
+	}
+	var c opi.Codec = framed
+	switch {
+	case os.Args[1] == "init-key":
+		keyed := len(a) == 1 && a[0] == "-keyed"
+		if len(a) == 1 && !keyed {
+			fmt.Fprint(os.Stderr, usage)
+			status = 1
+			return
 		}
+		c, err = opi.InitEncryption(s, framed, cfg, []byte(passphrase), keyed)
+	case passphrase != "":
+		c, err = opi.OpenEncryption(s, framed, cfg, []byte(passphrase))
+	default:
+		var encrypted bool
+		if encrypted, err = opi.IsEncrypted(s); encrypted {
+			err = errors.New("The repository is encrypted, OPI_PASSPHRASE is not set")
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+		return
+	}
+	// Once encryption is set, so that the dictionary is stored encrypted.
+	// Only archive stores it, the other commands read the stored ones.
+	var dict []byte
+	if os.Args[1] == "archive" {
+		dict, err = ZstdDict()
+	}
+	if err == nil {
+		err = opi.SetZstd(s, framed, level, dict)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+		return
 	}
+	o := opi.NewOpiWith(s, c, cfg)
 
-	if os.Args[1] == "restore" {
-		s := opi.NewClient()
-		//s := opi.NewDB()
-		defer s.Close()
-		c := opi.NewSimpleCodec()
-		o := opi.NewOpi(s, c)
-		err := o.Restore(os.Args[2], os.Args[3])
+	switch os.Args[1] {
+	case "init-key":
+		fmt.Fprintln(os.Stderr, "Key file created")
+	case "archive":
+		var opts opi.ArchiveOptions
+		flags := a[:len(a)-2]
+		for i := 0; i < len(flags); i++ {
+			switch {
+			case flags[i] == "-skip-errors":
+				opts.OnError = opi.SkipOnError
+			case flags[i] == "-record-skipped":
+				opts.OnError = opi.SkipOnError
+				opts.RecordSkipped = true
+			case flags[i] == "-exclude-caches":
+				opts.ExcludeCaches = true
+			case flags[i] == "-atime":
+				opts.RecordAtime = true
+			case flags[i] == "-exclude" && i+1 < len(flags):
+				i++
+				opts.Exclude = append(opts.Exclude, flags[i])
+			case flags[i] == "-exclude-file" && i+1 < len(flags):
+				i++
+				opts.ExcludeFiles = append(opts.ExcludeFiles, flags[i])
+			default:
+				fmt.Fprint(os.Stderr, usage)
+				status = 1
+				return
+			}
+		}
+		skipped, err := o.ArchiveWith(a[len(a)-2], a[len(a)-1], opts)
+		if len(skipped) > 0 {
+			fmt.Fprintf(os.Stderr, "%d files skipped:\n", len(skipped))
+			for _, s := range skipped {
+				fmt.Fprintf(os.Stderr, "  %s\n", s.Reason)
+			}
+		}
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	case "restore":
+		var opts opi.RestoreOptions
+		modes := map[string]opi.RestoreMode{"-overwrite": opi.Overwrite, "-sync": opi.Sync}
+		for _, flag := range a[:len(a)-2] {
+			mode, isMode := modes[flag]
+			switch {
+			case isMode && opts.Mode != opi.FailIfExists && opts.Mode != mode:
+				fmt.Fprintln(os.Stderr, "-overwrite and -sync are exclusive")
+				status = 1
+				return
+			case isMode:
+				opts.Mode = mode
+			case flag == "-delete":
+				opts.Delete = true
+			default:
+				fmt.Fprint(os.Stderr, usage)
+				status = 1
+				return
+			}
+		}
+		if opts.Delete && opts.Mode == opi.FailIfExists {
+			fmt.Fprintln(os.Stderr, "-delete requires -overwrite or -sync")
+			status = 1
+			return
+		}
+		name, inner := SplitName(a[len(a)-2])
+		err := o.RestoreWith(name, inner, a[len(a)-1], opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	case "gc":
+		dryRun := len(a) == 1 && a[0] == "-n"
+		if len(a) == 1 && !dryRun {
+			fmt.Fprint(os.Stderr, usage)
+			status = 1
+			return
+		}
+		count, size, err := o.GC(dryRun)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			return
+		}
+		if dryRun {
+			fmt.Printf("%d unreachable objects, %s reclaimable\n", count, bytefmt.ByteSize(size))
+		} else {
+			fmt.Printf("%d unreachable objects deleted, %s reclaimed\n", count, bytefmt.ByteSize(size))
+		}
+	case "rm":
+		if err := o.Remove(a[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	case "prune":
+		keep, err := strconv.Atoi(a[1])
+		if err != nil {
+			fmt.Fprint(os.Stderr, usage)
+			status = 1
+			return
+		}
+		if err = o.Prune(a[0], keep); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	case "list":
+		asJSON := len(a) == 1 && a[0] == "-json"
+		if len(a) == 1 && !asJSON {
+			fmt.Fprint(os.Stderr, usage)
+			status = 1
+			return
+		}
+		if err := List(o, cfg.Hash, asJSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	case "log":
+		if err := Log(o, cfg.Hash, a[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	case "ls":
+		var recursive, showACL bool
+		for _, flag := range a[:len(a)-1] {
+			switch flag {
+			case "-R":
+				recursive = true
+			case "-acl":
+				showACL = true
+			default:
+				fmt.Fprint(os.Stderr, usage)
+				status = 1
+				return
+			}
+		}
+		if err := Ls(o, cfg.Hash, a[len(a)-1], recursive, showACL); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	case "cat":
+		name, inner := SplitName(a[0])
+		stream := bufio.NewWriter(os.Stdout)
+		err := o.Cat(name, inner, stream)
+		if err == nil {
+			err = stream.Flush()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
 		}
 	}
-
 }
@@ -0,0 +1,719 @@
+package opi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In memory Storage, for testing purposes
+type memStorage struct {
+	sync.Mutex
+	objects map[string][]byte
+	refs    map[string][]byte
+	failSet error
+	sets    int
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		objects: make(map[string][]byte),
+		refs:    make(map[string][]byte),
+	}
+}
+
+func (m *memStorage) Get(key []byte) (value []byte, err error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.objects[string(key)], nil
+}
+
+func (m *memStorage) Set(key []byte, value []byte) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.sets++
+	if m.failSet != nil {
+		return m.failSet
+	}
+	m.objects[string(key)] = value
+	return nil
+}
+
+func (m *memStorage) Del(key []byte) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.objects, string(key))
+	return nil
+}
+
+func (m *memStorage) Hit(key []byte) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.objects[string(key)]; !ok {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *memStorage) Close() (err error) {
+	return nil
+}
+
+func (m *memStorage) GetRef(name []byte) (value []byte, err error) {
+	m.Lock()
+	defer m.Unlock()
+	value, ok := m.refs[string(name)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (m *memStorage) SetRef(name []byte, value []byte) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.refs[string(name)] = value
+	return nil
+}
+
+func (m *memStorage) DelRef(name []byte) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.refs, string(name))
+	return nil
+}
+
+func (m *memStorage) Keys(prefix []byte, fn func(key []byte) error) error {
+	return m.keys(m.objects, prefix, fn)
+}
+
+func (m *memStorage) Refs(prefix []byte, fn func(name []byte) error) error {
+	return m.keys(m.refs, prefix, fn)
+}
+
+func (m *memStorage) keys(table map[string][]byte, prefix []byte, fn func(key []byte) error) error {
+	m.Lock()
+	var keys []string
+	for k := range table {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	m.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn([]byte(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TempTree(t *testing.T) string {
+	root, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"small":     []byte("hello"),
+		"sub/large": bytes.Repeat(RandomBytes(), 1000),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("small", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestArchiveRestore(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"small", "sub/large"} {
+		expected, _ := ioutil.ReadFile(filepath.Join(src, name))
+		actual, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Fatalf("%s: restored content differs", name)
+		}
+	}
+	target, err := os.Readlink(filepath.Join(dst, "link"))
+	if err != nil || target != "small" {
+		t.Fatal("Incorrect symlink restored")
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i, exclude := range [][]string{nil, {"small"}} {
+		wg.Add(1)
+		go func(i int, exclude []string) {
+			defer wg.Done()
+			name := fmt.Sprintf("test%d", i)
+			_, errs[i] = o.ArchiveWith(src, name, ArchiveOptions{Exclude: exclude})
+		}(i, exclude)
+	}
+	wg.Wait()
+	for i, inner := range []string{"", "sub"} {
+		wg.Add(1)
+		go func(i int, inner string) {
+			defer wg.Done()
+			errs[2+i] = o.RestorePath("test0", inner, dst)
+		}(i, inner)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Cat("test1", "small", ioutil.Discard); err == nil {
+		t.Fatal("The exclude patterns of another archive applied")
+	}
+	if err := o.Cat("test0", "small", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveWriteError(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	s := newMemStorage()
+	s.failSet = errors.New("disk full")
+	o := NewOpi(s, NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != s.failSet {
+		t.Fatalf("Expected %v, got %v", s.failSet, err)
+	}
+	if _, ok := s.refs["test"]; ok {
+		t.Fatal("The name was written despite the failure")
+	}
+}
+
+func TestArchiveSkip(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	if err := os.Chmod(filepath.Join(src, "small"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.Open(filepath.Join(src, "small")); err == nil {
+		f.Close()
+		t.Skip("unreadable files can be read, e.g. by root")
+	}
+	s := newMemStorage()
+	o := NewOpi(s, NewSimpleCodec())
+	if err := o.Archive(src, "test"); err == nil {
+		t.Fatal("Expected an error for an unreadable file")
+	}
+	if _, ok := s.refs["test"]; ok {
+		t.Fatal("The name was written despite the failure")
+	}
+	opts := ArchiveOptions{OnError: SkipOnError, RecordSkipped: true}
+	skipped, err := o.ArchiveWith(src, "test", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].Path != "small" {
+		t.Fatalf("Unexpected skipped files %v", skipped)
+	}
+	err = o.History("test", func(addr []byte, c *Commit) error {
+		if !reflect.DeepEqual(c.Skipped, skipped) {
+			t.Fatalf("Skipped files not recorded: %v", c.Skipped)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Cat("test", "small", ioutil.Discard); err == nil {
+		t.Fatal("Skipped file found in the snapshot")
+	}
+}
+
+func TestArchiveExclude(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	files := map[string]string{
+		"sub/.opiignore":         "*.log\n",
+		"sub/debug.log":          "",
+		"debug.log":              "",
+		"excluded":               "",
+		"cache/CACHEDIR.TAG":     cacheDirSignature + "\n",
+		"cache/data":             "",
+		"node_modules/module.js": "",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludeFile := filepath.Join(src, "excludes")
+	if err := ioutil.WriteFile(excludeFile, []byte("node_modules/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	opts := ArchiveOptions{
+		Exclude:       []string{"/excluded", "/excludes"},
+		ExcludeFiles:  []string{excludeFile},
+		ExcludeCaches: true,
+	}
+	if _, err := o.ArchiveWith(src, "test", opts); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	err := o.Ls("test", "", true, func(path string, e *DirEntry) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "cache,cache/CACHEDIR.TAG,debug.log,link,small,sub,sub/.opiignore,sub/large"
+	if strings.Join(paths, ",") != expected {
+		t.Fatalf("Unexpected paths %v", paths)
+	}
+}
+
+func TestArchiveDedup(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	s := newMemStorage()
+	o := NewOpi(s, NewSimpleCodec())
+	if err := o.Archive(src, "first"); err != nil {
+		t.Fatal(err)
+	}
+	s.sets = 0
+	if err := o.Archive(src, "second"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the commit (the date changed) should be written
+	if s.sets > 1 {
+		t.Fatalf("Expected at most 1 write for an unchanged tree, got %d", s.sets)
+	}
+}
+
+func TestGC(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	s := newMemStorage()
+	o := NewOpi(s, NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	before := len(s.objects)
+	garbage, _ := NewSimpleCodec().Encode([]byte("garbage"))
+	s.objects[strings.Repeat("0", 128)] = garbage
+
+	count, size, err := o.GC(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || size != uint64(len(garbage)) || len(s.objects) != before+1 {
+		t.Fatalf("Dry run: got %d objects, %d bytes", count, size)
+	}
+	if count, _, err = o.GC(false); err != nil || count != 1 {
+		t.Fatalf("Expected 1 object collected, got %d (%v)", count, err)
+	}
+	if len(s.objects) != before {
+		t.Fatal("Reachable objects were deleted")
+	}
+}
+
+func TestRemovePrune(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	s := newMemStorage()
+	o := NewOpi(s, NewSimpleCodec())
+	if err := o.Archive(src, "other"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		content := []byte(fmt.Sprintf("version %d", i))
+		if err := ioutil.WriteFile(filepath.Join(src, "small"), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Archive(src, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Prune("test", 1); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := o.History("test", func(addr []byte, c *Commit) error { n++; return nil }); err != nil || n != 1 {
+		t.Fatalf("Expected 1 commit left, got %d (%v)", n, err)
+	}
+	if count, _, err := o.GC(false); err != nil || count == 0 {
+		t.Fatalf("Nothing collected after prune (%v)", err)
+	}
+	var buf bytes.Buffer
+	if err := o.Cat("test", "small", &buf); err != nil || buf.String() != "version 2" {
+		t.Fatalf("Unexpected content %q (%v)", buf.String(), err)
+	}
+
+	if err := o.Remove("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.refs["test"]; ok {
+		t.Fatal("The name was not removed")
+	}
+	// The other snapshot shares sub, but not small, the root and the
+	// commit
+	if count, _, err := o.GC(false); err != nil || count != 3 {
+		t.Fatalf("Expected 3 objects collected, got %d (%v)", count, err)
+	}
+	if err := o.Remove("test"); err == nil {
+		t.Fatal("Removed a missing snapshot")
+	}
+	if err := o.Cat("other", "small", &buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyName(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	s := newMemStorage()
+	o := NewOpi(s, NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// Move the name where older versions stored it
+	s.objects["test"] = s.refs["test"]
+	delete(s.refs, "test")
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	if count, _, err := o.GC(false); err != nil || count != 0 {
+		t.Fatalf("Expected nothing to collect, got %d (%v)", count, err)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	s := newMemStorage()
+	o := NewOpi(s, NewSimpleCodec())
+	for _, name := range []string{"", ".", "..", "a/../b", "a//b", "a/"} {
+		if err := o.Archive(src, name); err != ErrInvalidName {
+			t.Fatalf("%q: expected %v, got %v", name, ErrInvalidName, err)
+		}
+	}
+	if len(s.objects) != 0 {
+		t.Fatal("Objects stored for an invalid name")
+	}
+	if err := o.Archive(src, "host/home"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	for _, name := range []string{"b", "a"} {
+		if err := o.Archive(src, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names []string
+	err := o.Snapshots(func(name string, addr []byte, c *Commit) error {
+		if c.Date.IsZero() || len(c.Tree) == 0 {
+			t.Fatalf("%s: incomplete commit", name)
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "a,b" {
+		t.Fatalf("Unexpected snapshots %v", names)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	s := newMemStorage()
+	o := NewOpi(s, NewSimpleCodec())
+	for i := 0; i < 3; i++ {
+		if err := ioutil.WriteFile(filepath.Join(src, "small"), []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Archive(src, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var trees [][]byte
+	err := o.History("test", func(addr []byte, c *Commit) error {
+		trees = append(trees, c.Tree)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trees) != 3 || bytes.Equal(trees[0], trees[1]) || bytes.Equal(trees[1], trees[2]) {
+		t.Fatalf("Expected 3 distinct trees in the history, got %d", len(trees))
+	}
+	// Older snapshots remain reachable through the history
+	if count, _, err := o.GC(false); err != nil || count != 0 {
+		t.Fatalf("Expected nothing to collect, got %d (%v)", count, err)
+	}
+}
+
+func TestRestorePath(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// A file lands inside an existing directory
+	if err := o.RestorePath("test", "sub/large", dst); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := ioutil.ReadFile(filepath.Join(src, "sub/large"))
+	actual, err := ioutil.ReadFile(filepath.Join(dst, "large"))
+	if err != nil || !bytes.Equal(expected, actual) {
+		t.Fatal("Incorrect file restored")
+	}
+	// Or at the given path
+	if err := o.RestorePath("test", "small", filepath.Join(dst, "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := ioutil.ReadFile(filepath.Join(dst, "renamed")); string(actual) != "hello" {
+		t.Fatal("Incorrect file restored")
+	}
+	// The content of a directory lands in the destination
+	if err := os.Mkdir(filepath.Join(dst, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RestorePath("test", "/sub/", filepath.Join(dst, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "dir", "large")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RestorePath("test", "sub/missing", dst); err == nil {
+		t.Fatal("Expected an error for a missing path")
+	}
+}
+
+func TestRestoreModes(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Restore("test", dst); err == nil {
+		t.Fatal("Expected an error for an existing destination")
+	}
+	if err := o.RestoreWith("test", "", dst, RestoreOptions{Delete: true}); err == nil {
+		t.Fatal("Expected an error for Delete without Overwrite or Sync")
+	}
+	// Same size, different content and modification time
+	if err := ioutil.WriteFile(filepath.Join(dst, "small"), []byte("jello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "extra"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(filepath.Join(dst, "sub/large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RestoreWith("test", "", dst, RestoreOptions{Mode: Sync, Delete: true}); err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := ioutil.ReadFile(filepath.Join(dst, "small")); string(actual) != "hello" {
+		t.Fatal("Changed file not restored")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "extra")); !os.IsNotExist(err) {
+		t.Fatal("Extra file not deleted")
+	}
+	after, err := os.Stat(filepath.Join(dst, "sub/large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Fatal("Unchanged file rewritten")
+	}
+	if err := o.RestoreWith("test", "", dst, RestoreOptions{Mode: Overwrite}); err != nil {
+		t.Fatal(err)
+	}
+	after, err = os.Stat(filepath.Join(dst, "sub/large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Fatal("File not overwritten")
+	}
+	expected, _ := ioutil.ReadFile(filepath.Join(src, "sub/large"))
+	actual, err := ioutil.ReadFile(filepath.Join(dst, "sub/large"))
+	if err != nil || !bytes.Equal(expected, actual) {
+		t.Fatal("Incorrect file restored")
+	}
+}
+
+func TestCat(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := o.Cat("test", "sub/large", &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := ioutil.ReadFile(filepath.Join(src, "sub/large"))
+	if !bytes.Equal(expected, buf.Bytes()) {
+		t.Fatal("Incorrect content")
+	}
+	if err := o.Cat("test", "sub", &buf); err == nil {
+		t.Fatal("Expected an error for a directory")
+	}
+}
+
+func TestLs(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[string]uint64)
+	err := o.Ls("test", "", true, func(path string, e *DirEntry) error {
+		size, err := o.Size(e)
+		sizes[path] = size
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint64{"small": 5, "link": 5, "sub": 0}
+	info, _ := os.Stat(filepath.Join(src, "sub/large"))
+	expected["sub/large"] = uint64(info.Size())
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Fatalf("Expected %v, got %v", expected, sizes)
+	}
+}
+
+func TestRestoreMetadata(t *testing.T) {
+	src := TempTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "opi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 789, time.UTC)
+	modes := map[string]os.FileMode{
+		"small": 0754 | os.ModeSetuid,
+		"sub":   0755 | os.ModeSticky,
+	}
+	for name, mode := range modes {
+		if err := os.Chmod(filepath.Join(src, name), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(src, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := NewOpi(newMemStorage(), NewSimpleCodec())
+	if err := o.Archive(src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Restore("test", dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"small", "sub"} {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Fatalf("%s: expected mtime %v, got %v", name, mtime, info.ModTime())
+		}
+		if m := info.Mode() &^ os.ModeDir; m != modes[name] {
+			t.Fatalf("%s: expected mode %v, got %v", name, modes[name], m)
+		}
+	}
+}